@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/1lann/dynamicserver/control"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// loadTLSConfig loads the certificate issued by the reverse proxy, and pins
+// the reverse proxy's certificate for connections in both directions.
+func loadTLSConfig(config Config) *tls.Config {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		Fatal("communications", err)
+	}
+
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(resolve(config.TLS.Certificate),
+		resolve(config.TLS.Key))
+	if err != nil {
+		Fatal("communications", "Failed to load TLS certificate:", err)
+	}
+
+	proxyPEM, err := ioutil.ReadFile(resolve(config.TLS.ProxyCertificate))
+	if err != nil {
+		Fatal("communications", "Failed to read proxy certificate:", err)
+	}
+
+	verifier, err := control.PinnedVerifier(proxyPEM)
+	if err != nil {
+		Fatal("communications", "Failed to load proxy certificate:", err)
+	}
+
+	// Verification is done entirely by pinning, the reverse proxy's
+	// certificate is not issued for any host name.
+	return &tls.Config{
+		Certificates:          []tls.Certificate{certificate},
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifier,
+	}
+}
+
+// sendState reports the current state to every master, retrying failures.
+func sendState() {
+	forEachMaster(func(address string) {
+		for i := 0; i < 3; i++ {
+			err := sendStateOnce(address)
+			if err == nil {
+				return
+			}
+
+			Warn("communications", "Could not send state to master "+
+				address+":", err)
+
+			if _, rejected := err.(*control.RemoteError); rejected {
+				return
+			}
+
+			time.Sleep(time.Second)
+		}
+	})
+}
+
+// forEachMaster calls send for the address of every master concurrently, so
+// that an unreachable master doesn't hold up the others. It returns once all
+// calls have returned.
+func forEachMaster(send func(address string)) {
+	wg := &sync.WaitGroup{}
+	for _, address := range masterAddresses(getConfig()) {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			send(address)
+		}(address)
+	}
+
+	wg.Wait()
+}
+
+func sendStateOnce(address string) error {
+	conn, err := dialMaster(address)
+	if err != nil {
+		return err
+	}
+
+	master := control.NewConn(conn, getAuth())
+	defer master.Close()
+
+	if getConfig().LegacyProtocol {
+		return master.WriteLegacy(legacyState())
+	}
+
+	message, err := control.NewMessage(control.TypeState, stateData())
+	if err != nil {
+		return err
+	}
+
+	master.SetDeadline(time.Now().Add(time.Second * 10))
+	_, err = master.Request(message)
+	return err
+}
+
+// stateData returns the current state, along with the exit code and crash
+// report if the server has stopped.
+func stateData() control.StateData {
+	data := control.StateData{State: currentState}
+	if currentState == stateStarted {
+		return data
+	}
+
+	if supervised(getConfig()) {
+		exitCode := minecraftProcess.ExitCode()
+		data.ExitCode = &exitCode
+	}
+
+	if currentState == stateStopped || currentState == stateCrashed {
+		data.StartFailure = startFailure
+	}
+
+	if currentState == stateRestarting || currentState == stateCrashed {
+		data.CrashReport = crashReport
+		data.CrashReportFile = crashReportFile
+		data.Restarts = len(restartTimes)
+	}
+
+	if currentState == stateCrashed {
+		data.RetryingRestart = retryingRestart
+	}
+
+	return data
+}
+
+// legacyState returns the current state as understood by reverse proxies
+// older than v0.2, which only know of started and stopped.
+func legacyState() string {
+	if currentState == stateStarted {
+		return stateStarted
+	}
+
+	return stateStopped
+}
+
+func dialMaster(address string) (net.Conn, error) {
+	if tlsConfig != nil {
+		dialer := &net.Dialer{Timeout: time.Second * 5}
+		return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	}
+
+	return net.DialTimeout("tcp", address, time.Second*5)
+}
+
+func respondState() {
+	listener, err := net.Listen("tcp", ":"+getConfig().CommunicationsPort)
+	if err != nil {
+		Fatal("communications", err)
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			Fatal("communications", err)
+		}
+
+		if !controllerAllowed(conn.RemoteAddr().String()) {
+			Warn("communications", "Received connection from unknown address:",
+				conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		go handleMaster(control.NewConn(conn, getAuth()))
+	}
+}
+
+// replyTimeout is how long replying to the master may take once a request
+// has been handled.
+const replyTimeout = time.Second * 10
+
+// stopTimeout is how long stopping the server may take, which is saving and
+// stopping it over RCON, and then falling back to the stop command.
+func stopTimeout(config Config) time.Duration {
+	return rconDialTimeout*2 + rconCommandTimeout*2 +
+		config.StopCommand.timeout() + replyTimeout
+}
+
+// shutdownTimeout is how long shutting down may take.
+func shutdownTimeout(config Config) time.Duration {
+	return config.ShutdownCommand.timeout() + replyTimeout
+}
+
+func handleMaster(master *control.Conn) {
+	defer master.Close()
+
+	// The configuration is read once, so that a reload can't change it
+	// halfway through handling the request.
+	config := getConfig()
+
+	master.SetDeadline(time.Now().Add(time.Second * 10))
+
+	var err error
+	if config.LegacyProtocol {
+		_, err = master.Write([]byte(getAuth().Sign(legacyState()) + "\n"))
+	} else {
+		var hello control.Message
+		// The master waits as long as we may take to stop or shut down.
+		hello, err = control.NewMessage(control.TypeHello,
+			control.StateData{
+				State: currentState,
+				StopTimeoutSeconds: int(stopTimeout(config) /
+					time.Second),
+				ShutdownTimeoutSeconds: int(shutdownTimeout(config) /
+					time.Second),
+			})
+		if err == nil {
+			err = master.Send(hello)
+		}
+	}
+
+	if err != nil {
+		Warn("communications", "Failed to write response:", err)
+		return
+	}
+
+	request, err := master.Receive()
+	if err == control.ErrUnsupportedVersion {
+		Warn("communications", "Master uses unsupported protocol version:",
+			request.Version)
+		master.Send(request.Reject(err.Error()))
+		return
+	} else if err != nil {
+		// The master hung up after reading our state.
+		return
+	}
+
+	reply := func(data interface{}, err error) {
+		if request.Version == 0 {
+			return
+		}
+
+		if err != nil {
+			master.Send(request.Reject(err.Error()))
+			return
+		}
+
+		ack, err := request.Ack(data)
+		if err == nil {
+			err = master.Send(ack)
+		}
+
+		if err != nil {
+			Warn("communications", "Failed to acknowledge request:", err)
+		}
+	}
+
+	switch request.Type {
+	case control.TypeStop:
+		Log("communications", "Received request to stop.")
+		master.SetDeadline(time.Now().Add(stopTimeout(config)))
+		reply(stopServer(config))
+	case control.TypeShutdown:
+		Log("communications", "Received request to shutdown.")
+		master.SetDeadline(time.Now().Add(shutdownTimeout(config)))
+		reply(shutdownServer(config))
+	case control.TypeCommand:
+		var data control.CommandData
+		if err := request.Decode(&data); err != nil {
+			reply(nil, err)
+			return
+		}
+
+		// Commands may take a while, such as saving the world.
+		master.SetDeadline(time.Now().Add(time.Minute))
+		reply(runConsoleCommand(config, data.Command))
+	default:
+		Warn("communications", "Received unknown command:", request.Type)
+		if request.Version > 0 {
+			master.Send(request.Reject("unknown message type"))
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/1lann/dynamicserver/control"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Commands in the configuration can be written as a string, which is split
+// into arguments like a shell would without expanding anything, as an array
+// of arguments, or as an object with more options:
+//
+//	{
+//		"command": ["java", "-jar", "minecraft.jar"] or "a string",
+//		"shell": false, // Run a string command with /bin/sh -c instead
+//		"env": {"NAME": "value"},
+//		"user": "minecraft",
+//		"timeout_seconds": 60,
+//		"working_directory": "/root/minecraft"
+//	}
+//
+// Commands are killed once they time out, except for the start command,
+// which is left running instead, as it may run the server in the foreground.
+
+const defaultCommandTimeout = time.Minute
+
+// defaultStartWait is how long the start command is waited on to exit by
+// default, before it is taken to be running the server in the foreground.
+const defaultStartWait = time.Second * 10
+
+const maxCommandOutput = 64 * 1024
+
+var (
+	errNoCommand         = errors.New("command: no command configured")
+	errUnterminatedQuote = errors.New("command: unterminated quote")
+	errCommandTimeout    = errors.New("command: timed out")
+)
+
+type commandSpec struct {
+	Args             []string
+	Env              map[string]string
+	User             string
+	Timeout          time.Duration
+	WorkingDirectory string
+}
+
+func (c *commandSpec) UnmarshalJSON(data []byte) error {
+	var options struct {
+		Command          json.RawMessage   `json:"command"`
+		Shell            bool              `json:"shell"`
+		Env              map[string]string `json:"env"`
+		User             string            `json:"user"`
+		TimeoutSeconds   int               `json:"timeout_seconds"`
+		WorkingDirectory string            `json:"working_directory"`
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &options); err != nil {
+			return err
+		}
+
+		data = options.Command
+	}
+
+	*c = commandSpec{
+		Env:              options.Env,
+		User:             options.User,
+		Timeout:          time.Duration(options.TimeoutSeconds) * time.Second,
+		WorkingDirectory: options.WorkingDirectory,
+	}
+
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+
+	if data[0] == '[' {
+		return json.Unmarshal(data, &c.Args)
+	}
+
+	var command string
+	if err := json.Unmarshal(data, &command); err != nil {
+		return err
+	}
+
+	if options.Shell {
+		c.Args = []string{"/bin/sh", "-c", command}
+		return nil
+	}
+
+	args, err := splitCommand(command)
+	c.Args = args
+	return err
+}
+
+func (c commandSpec) Configured() bool {
+	return len(c.Args) > 0
+}
+
+func (c commandSpec) String() string {
+	encoded, _ := json.Marshal(c.Args)
+	return string(encoded)
+}
+
+// splitCommand splits a command into arguments following the quoting rules
+// of a POSIX shell. Nothing is expanded.
+func splitCommand(command string) ([]string, error) {
+	var args []string
+	var current []rune
+	inWord := false
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, string(current))
+				current = current[:0]
+				inWord = false
+			}
+		case r == '\\':
+			inWord = true
+			if i+1 < len(runes) {
+				i++
+				// An escaped newline continues the line.
+				if runes[i] != '\n' {
+					current = append(current, runes[i])
+				}
+			}
+		case r == '\'':
+			inWord = true
+			end := i + 1
+			for end < len(runes) && runes[end] != '\'' {
+				end++
+			}
+
+			if end >= len(runes) {
+				return nil, errUnterminatedQuote
+			}
+
+			current = append(current, runes[i+1:end]...)
+			i = end
+		case r == '"':
+			inWord = true
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) &&
+					isDoubleQuoteEscape(runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+
+				current = append(current, runes[i])
+			}
+
+			if i >= len(runes) {
+				return nil, errUnterminatedQuote
+			}
+		default:
+			inWord = true
+			current = append(current, r)
+		}
+	}
+
+	if inWord {
+		args = append(args, string(current))
+	}
+
+	return args, nil
+}
+
+// isDoubleQuoteEscape returns whether a backslash followed by r is an escape
+// sequence within double quotes.
+func isDoubleQuoteEscape(r rune) bool {
+	return r == '$' || r == '`' || r == '"' || r == '\\' || r == '\n'
+}
+
+// prepare creates the command, running in defaultDir unless the command has
+// its own working directory.
+func (c commandSpec) prepare(ctx context.Context,
+	defaultDir string) (*exec.Cmd, error) {
+	if !c.Configured() {
+		return nil, errNoCommand
+	}
+
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+
+	cmd.Dir = defaultDir
+	if c.WorkingDirectory != "" {
+		cmd.Dir = c.WorkingDirectory
+	}
+
+	cmd.Env = os.Environ()
+
+	if c.User != "" {
+		account, err := user.Lookup(c.User)
+		if err != nil {
+			return nil, err
+		}
+
+		uid, err := strconv.ParseUint(account.Uid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		gid, err := strconv.ParseUint(account.Gid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{
+				Uid: uint32(uid),
+				Gid: uint32(gid),
+			},
+		}
+
+		cmd.Env = append(cmd.Env, "USER="+account.Username,
+			"HOME="+account.HomeDir)
+	}
+
+	for name, value := range c.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+
+	return cmd, nil
+}
+
+// timeout returns how long the command may run for.
+func (c commandSpec) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultCommandTimeout
+	}
+
+	return c.Timeout
+}
+
+// run runs the command to completion, and returns its exit code and output.
+// An error is only returned if the command could not be run or timed out, a
+// non-zero exit code is not an error.
+func (c commandSpec) run(defaultDir string) (control.CommandResultData,
+	error) {
+	result := control.CommandResultData{Method: "command"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+
+	cmd, err := c.prepare(ctx, defaultDir)
+	if err != nil {
+		return result, err
+	}
+
+	// Output goes to a file rather than a pipe, as commands such as screen
+	// leave processes behind which would hold a pipe open.
+	output, err := ioutil.TempFile("", "dynamicserver-command")
+	if err != nil {
+		return result, err
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err = cmd.Run()
+
+	output.Seek(0, io.SeekStart)
+	data, _ := ioutil.ReadAll(io.LimitReader(output, maxCommandOutput))
+	result.Output = string(data)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return result, errCommandTimeout
+	}
+
+	return result, setExitCode(&result, err)
+}
+
+// start starts the command, and waits for it to exit for as long as its
+// timeout, or defaultStartWait, returning its exit code and output like run.
+// A command which is still running after that, such as a server run in the
+// foreground, is left running, and its result has no exit code.
+func (c commandSpec) start(defaultDir string) (control.CommandResultData,
+	error) {
+	result := control.CommandResultData{Method: "command"}
+
+	wait := defaultStartWait
+	if c.Timeout > 0 {
+		wait = c.Timeout
+	}
+
+	cmd, err := c.prepare(context.Background(), defaultDir)
+	if err != nil {
+		return result, err
+	}
+
+	// The output is read from a pipe which is drained for as long as
+	// anything holds it open, so that a command left running never blocks
+	// on writing its output, and never fills up a file with it.
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return result, err
+	}
+
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		reader.Close()
+		return result, err
+	}
+
+	output := &outputBuffer{lock: &sync.Mutex{}}
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(output, reader)
+		reader.Close()
+		close(drained)
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-exited:
+	case <-time.After(wait):
+		result.Output = output.String()
+		return result, nil
+	}
+
+	// Processes left behind by the command, such as screen's, may hold the
+	// pipe open, so the rest of the output is only waited on briefly.
+	select {
+	case <-drained:
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	result.Output = output.String()
+	return result, setExitCode(&result, err)
+}
+
+// setExitCode sets the exit code of the result from the error returned by
+// running its command. An error is only returned if the command could not be
+// run, a non-zero exit code is not an error.
+func setExitCode(result *control.CommandResultData, err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode := -1
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok &&
+			!status.Signaled() {
+			exitCode = status.ExitStatus()
+		}
+
+		result.ExitCode = &exitCode
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	exitCode := 0
+	result.ExitCode = &exitCode
+	return nil
+}
+
+// outputBuffer keeps the first maxCommandOutput bytes written to it, and
+// discards the rest.
+type outputBuffer struct {
+	lock *sync.Mutex
+	data []byte
+}
+
+func (b *outputBuffer) Write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if room := maxCommandOutput - len(b.data); room > 0 {
+		if len(data) < room {
+			room = len(data)
+		}
+
+		b.data = append(b.data, data[:room]...)
+	}
+
+	return len(data), nil
+}
+
+func (b *outputBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return string(b.data)
+}
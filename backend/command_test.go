@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		args    []string
+		err     error
+	}{
+		{"", nil, nil},
+		{"   \t\n", nil, nil},
+		{"screen -list", []string{"screen", "-list"}, nil},
+		{"  shutdown\t-P   now \n", []string{"shutdown", "-P", "now"}, nil},
+		{"echo 'a b'", []string{"echo", "a b"}, nil},
+		{`echo "a b"`, []string{"echo", "a b"}, nil},
+		{`echo ''`, []string{"echo", ""}, nil},
+		{`echo ""`, []string{"echo", ""}, nil},
+		{`echo a'b c'd`, []string{"echo", "ab cd"}, nil},
+		{`echo 'a'"b"c`, []string{"echo", "abc"}, nil},
+		{`echo 'a "b" \c'`, []string{"echo", `a "b" \c`}, nil},
+		{`echo "a 'b'"`, []string{"echo", "a 'b'"}, nil},
+		{`echo a\ b`, []string{"echo", "a b"}, nil},
+		{`echo \'a\"`, []string{"echo", `'a"`}, nil},
+		{`echo \\`, []string{"echo", `\`}, nil},
+		{"echo a\\\nb", []string{"echo", "ab"}, nil},
+		{`echo "\"a\" \\ \$ \` + "`" + `"`,
+			[]string{"echo", `"a" \ $ ` + "`"}, nil},
+		{`echo "\a \n"`, []string{"echo", `\a \n`}, nil},
+		{"echo \"a\\\nb\"", []string{"echo", "ab"}, nil},
+		{`screen -S minecraft -X stuff "stop\n"`,
+			[]string{"screen", "-S", "minecraft", "-X", "stuff", `stop\n`},
+			nil},
+		{"echo 'a", nil, errUnterminatedQuote},
+		{`echo "a`, nil, errUnterminatedQuote},
+		{`echo "a\"`, nil, errUnterminatedQuote},
+		{`echo 'a'"`, nil, errUnterminatedQuote},
+	}
+
+	for _, test := range tests {
+		args, err := splitCommand(test.command)
+		if err != test.err {
+			t.Errorf("splitCommand(%q) got error %v, want %v", test.command,
+				err, test.err)
+			continue
+		}
+
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitCommand(%q) got %q, want %q", test.command, args,
+				test.args)
+		}
+	}
+}
+
+func TestStartCommand(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		command string
+		// exitCode is the expected exit code, or -2 if the command should
+		// be left running.
+		exitCode int
+		output   string
+	}{
+		{"exits", "echo started", 0, "started\n"},
+		{"fails", "echo failed >&2; exit 3", 3, "failed\n"},
+		// Like screen, leaving a process behind holding the output open.
+		{"leaves a process behind", "sleep 2 & echo launched", 0,
+			"launched\n"},
+		{"runs in the foreground", "echo running; sleep 1; touch " + dir +
+			"/finished; sleep 1", -2, "running\n"},
+	}
+
+	for _, test := range tests {
+		command := commandSpec{
+			Args:    []string{"/bin/sh", "-c", test.command},
+			Timeout: time.Millisecond * 500,
+		}
+
+		started := time.Now()
+		result, err := command.start(dir)
+		if err != nil {
+			t.Errorf("%s: failed to start: %v", test.name, err)
+			continue
+		}
+
+		if time.Since(started) > time.Second {
+			t.Errorf("%s: start took %v", test.name, time.Since(started))
+		}
+
+		if result.Output != test.output {
+			t.Errorf("%s: got output %q, want %q", test.name, result.Output,
+				test.output)
+		}
+
+		if test.exitCode == -2 && result.ExitCode != nil {
+			t.Errorf("%s: got exit code %d, want it to be left running",
+				test.name, *result.ExitCode)
+		} else if test.exitCode != -2 && (result.ExitCode == nil ||
+			*result.ExitCode != test.exitCode) {
+			t.Errorf("%s: got exit code %v, want %d", test.name,
+				result.ExitCode, test.exitCode)
+		}
+	}
+
+	// The command left running was not killed.
+	time.Sleep(time.Second)
+	if _, err := os.Stat(dir + "/finished"); err != nil {
+		t.Error("expected the command left running to keep running:", err)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	command := commandSpec{
+		Args:    []string{"/bin/sh", "-c", "echo running; sleep 5"},
+		Timeout: time.Millisecond * 200,
+	}
+
+	result, err := command.run(t.TempDir())
+	if err != errCommandTimeout {
+		t.Errorf("expected %v, but got %v", errCommandTimeout, err)
+	}
+
+	if result.Output != "running\n" {
+		t.Errorf("got output %q, want %q", result.Output, "running\n")
+	}
+}
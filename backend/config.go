@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/1lann/dynamicserver/control"
+	"github.com/1lann/dynamicserver/logging"
+	"gopkg.in/fsnotify.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Check struct {
+		Command  commandSpec `json:"command"`
+		Contains string      `json:"contains"`
+	} `json:"check"`
+	MasterAddress      string      `json:"master_address"`
+	Masters            []string    `json:"masters"`
+	AllowedControllers []string    `json:"allowed_controllers"`
+	CommunicationsPort string      `json:"communications_port"`
+	StartCommand       commandSpec `json:"start_command"`
+	StopCommand        commandSpec `json:"stop_command"`
+	ShutdownCommand    commandSpec `json:"shutdown_command"`
+	WorkingDirectory   string      `json:"working_directory"`
+	ControlSecret      string      `json:"control_secret"`
+	LegacyProtocol     bool        `json:"legacy_protocol"`
+	HeartbeatSeconds   int         `json:"heartbeat_seconds"`
+	MinecraftPort      string      `json:"minecraft_port"`
+	ServerLog          string      `json:"server_log"`
+	RCON               struct {
+		Address  string `json:"address"`
+		Password string `json:"password"`
+	} `json:"rcon"`
+	Process struct {
+		Command commandSpec `json:"command"`
+		LogFile string      `json:"log_file"`
+		// LogMaxSizeMB and LogMaxFiles rotate the log file, like the
+		// options of the same name in logging.
+		LogMaxSizeMB int `json:"max_size_mb"`
+		LogMaxFiles  int `json:"max_files"`
+	} `json:"process"`
+	CrashRecovery struct {
+		Enabled           bool `json:"enabled"`
+		MaxRestarts       int  `json:"max_restarts"`
+		WindowMinutes     int  `json:"window_minutes"`
+		BackoffSeconds    int  `json:"backoff_seconds"`
+		MaxBackoffSeconds int  `json:"max_backoff_seconds"`
+	} `json:"crash_recovery"`
+	TLS struct {
+		Certificate      string `json:"certificate"`
+		Key              string `json:"key"`
+		ProxyCertificate string `json:"proxy_certificate"`
+	} `json:"tls"`
+	Logging logging.Config `json:"logging"`
+}
+
+// The configuration is replaced whenever it is reloaded, so it is only
+// accessed through getConfig and setConfig. The authenticator made from the
+// control secret is replaced along with it.
+var configLock = &sync.RWMutex{}
+var currentConfig Config
+var auth *control.Authenticator
+
+func getConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return currentConfig
+}
+
+func getAuth() *control.Authenticator {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return auth
+}
+
+func setConfig(newConfig Config, newAuth *control.Authenticator) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	currentConfig = newConfig
+	auth = newAuth
+}
+
+func configPath() string {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		Fatal("config", err)
+	}
+
+	return filepath.Join(dir, "config.json")
+}
+
+func loadConfig() Config {
+	loadedConfig, err := readConfig()
+	if err != nil {
+		Fatal("config", err)
+	}
+
+	if err := validateConfig(loadedConfig); err != nil {
+		Fatal("config", "Invalid configuration:", err)
+	}
+
+	networks, err := parseControllers(loadedConfig)
+	if err != nil {
+		Fatal("config", "Invalid allowed_controllers:", err)
+	}
+
+	setAllowedControllers(networks)
+	return loadedConfig
+}
+
+func readConfig() (Config, error) {
+	var loadedConfig Config
+
+	data, err := ioutil.ReadFile(configPath())
+	if err != nil {
+		return loadedConfig, err
+	}
+
+	err = json.Unmarshal(data, &loadedConfig)
+	return loadedConfig, err
+}
+
+// validateConfig checks that everything needed to run is configured.
+func validateConfig(c Config) error {
+	if len(masterAddresses(c)) == 0 {
+		return errors.New("neither masters nor master_address are set")
+	}
+
+	if _, err := strconv.ParseUint(c.CommunicationsPort, 10, 16); err != nil {
+		return errors.New("communications_port is not a valid port")
+	}
+
+	if !c.Process.Command.Configured() {
+		if !c.StartCommand.Configured() {
+			return errors.New("neither process nor start_command are set")
+		}
+
+		if !c.Check.Command.Configured() || c.Check.Contains == "" {
+			return errors.New("check is required without process")
+		}
+
+		if !c.StopCommand.Configured() && c.RCON.Address == "" {
+			return errors.New("neither rcon nor stop_command are set")
+		}
+	}
+
+	if !c.ShutdownCommand.Configured() {
+		return errors.New("shutdown_command is not set")
+	}
+
+	if c.TLS.Certificate != "" && (c.TLS.Key == "" ||
+		c.TLS.ProxyCertificate == "") {
+		return errors.New("tls requires certificate, key and " +
+			"proxy_certificate")
+	}
+
+	if err := c.Logging.Validate(); err != nil {
+		return errors.New("logging: " + err.Error())
+	}
+
+	return nil
+}
+
+func liveLoadConfig() {
+	time.Sleep(time.Second * 3)
+
+	config := getConfig()
+
+	newConfig, err := readConfig()
+	if err != nil {
+		Warn("config", "Failed to reload configuration, keeping the current "+
+			"configuration:", err)
+		return
+	}
+
+	if err := validateConfig(newConfig); err != nil {
+		Warn("config", "Invalid configuration, keeping the current "+
+			"configuration:", err)
+		return
+	}
+
+	networks, err := parseControllers(newConfig)
+	if err != nil {
+		Warn("config", "Invalid allowed_controllers, keeping the current "+
+			"configuration:", err)
+		return
+	}
+
+	// Settings which are only used at startup are kept as they were.
+	if newConfig.CommunicationsPort != config.CommunicationsPort {
+		Log("config", "The communications port has changed. You must "+
+			"restart the backend to use the new communications port.")
+		newConfig.CommunicationsPort = config.CommunicationsPort
+	}
+
+	if newConfig.TLS != config.TLS {
+		Log("config", "The TLS settings have changed. You must restart "+
+			"the backend to use the new TLS settings.")
+		newConfig.TLS = config.TLS
+	}
+
+	if newConfig.Logging.Directory != config.Logging.Directory {
+		Log("config", "The log directory has changed. You must restart "+
+			"the backend to use the new log directory.")
+		newConfig.Logging.Directory = config.Logging.Directory
+	}
+
+	if newConfig.LegacyProtocol != config.LegacyProtocol {
+		Log("config", "legacy_protocol has changed. You must restart "+
+			"the backend to change protocols.")
+		newConfig.LegacyProtocol = config.LegacyProtocol
+	}
+
+	if newConfig.Process.Command.Configured() !=
+		config.Process.Command.Configured() {
+		Log("config", "Switching between process and start_command "+
+			"requires restarting the backend.")
+		newConfig.Process = config.Process
+		newConfig.StartCommand = config.StartCommand
+		newConfig.Check = config.Check
+	}
+
+	if reflect.DeepEqual(newConfig, config) {
+		return
+	}
+
+	newAuth := getAuth()
+	if newConfig.ControlSecret != config.ControlSecret {
+		newAuth = control.NewAuthenticator(newConfig.ControlSecret)
+		Log("config", "Control secret changed.")
+	}
+
+	setConfig(newConfig, newAuth)
+	setAllowedControllers(networks)
+	configureLogging(newConfig)
+	Log("config", "Reloaded configuration.")
+
+	// Check the state again in case the check changed.
+	signalStateChange()
+}
+
+// watchConfig reloads the configuration whenever it changes. The directory
+// is watched rather than the file, as editors often replace the file.
+func watchConfig() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		Fatal("config", err)
+	}
+
+	path := configPath()
+
+	go func() {
+		for {
+			select {
+			case event := <-watcher.Events:
+				if filepath.Clean(event.Name) != path {
+					continue
+				}
+
+				if event.Op&fsnotify.Write == fsnotify.Write ||
+					event.Op&fsnotify.Create == fsnotify.Create {
+					liveLoadConfig()
+				}
+			case err := <-watcher.Errors:
+				Warn("config watcher", err)
+			}
+		}
+	}()
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		Fatal("config", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// The backend reports to every reverse proxy in masters, and accepts control
+// connections from any address in allowed_controllers, which may be IP
+// addresses, host names or CIDR ranges, IPv4 or IPv6. Ports are ignored.
+// Without allowed_controllers, only the masters are allowed.
+
+var controllersLock = &sync.Mutex{}
+var allowedControllers []*net.IPNet
+
+// masterAddresses returns the address and port of every reverse proxy to
+// report to.
+func masterAddresses(c Config) []string {
+	masters := c.Masters
+	if len(masters) == 0 && c.MasterAddress != "" {
+		masters = []string{c.MasterAddress}
+	}
+
+	var addresses []string
+	for _, master := range masters {
+		host, port, err := net.SplitHostPort(master)
+		if err != nil {
+			// No port, which is the usual case.
+			host = strings.Trim(master, "[]")
+			port = c.CommunicationsPort
+		}
+
+		addresses = append(addresses, net.JoinHostPort(host, port))
+	}
+
+	return addresses
+}
+
+// parseControllers resolves the allowed controllers into networks.
+func parseControllers(c Config) ([]*net.IPNet, error) {
+	entries := c.AllowedControllers
+	if len(entries) == 0 {
+		for _, address := range masterAddresses(c) {
+			host, _, _ := net.SplitHostPort(address)
+			entries = append(entries, host)
+		}
+	}
+
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+
+			networks = append(networks, network)
+			continue
+		}
+
+		if host, _, err := net.SplitHostPort(entry); err == nil {
+			// The port of the controller isn't known in advance.
+			entry = host
+		}
+
+		ips := []net.IP{net.ParseIP(entry)}
+		if ips[0] == nil {
+			var err error
+			ips, err = net.LookupIP(entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, ip := range ips {
+			networks = append(networks, singleIPNetwork(ip))
+		}
+	}
+
+	if len(networks) == 0 {
+		return nil, errors.New("no controllers are allowed")
+	}
+
+	return networks, nil
+}
+
+func singleIPNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func setAllowedControllers(networks []*net.IPNet) {
+	controllersLock.Lock()
+	defer controllersLock.Unlock()
+	allowedControllers = networks
+}
+
+// controllerAllowed returns whether a connection from the address, which
+// includes its port, is allowed to control the backend.
+func controllerAllowed(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	controllersLock.Lock()
+	defer controllersLock.Unlock()
+
+	for _, network := range allowedControllers {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
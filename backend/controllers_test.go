@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestControllerAllowed(t *testing.T) {
+	tests := []struct {
+		name        string
+		controllers []string
+		masters     []string
+		address     string
+		allowed     bool
+	}{
+		{"IPv4", []string{"203.0.113.5"}, nil, "203.0.113.5:40000", true},
+		{"other IPv4", []string{"203.0.113.5"}, nil, "203.0.113.6:40000",
+			false},
+		{"IPv6", []string{"2001:db8::5"}, nil, "[2001:db8::5]:40000", true},
+		{"other IPv6", []string{"2001:db8::5"}, nil, "[2001:db8::6]:40000",
+			false},
+		{"IPv4 CIDR", []string{"203.0.113.0/24"}, nil, "203.0.113.200:1",
+			true},
+		{"outside IPv4 CIDR", []string{"203.0.113.0/24"}, nil,
+			"203.0.114.1:1", false},
+		{"IPv6 CIDR", []string{"2001:db8::/64"}, nil,
+			"[2001:db8::ffff:1]:1", true},
+		{"outside IPv6 CIDR", []string{"2001:db8::/64"}, nil,
+			"[2001:db8:0:1::1]:1", false},
+		{"IPv4-mapped IPv6", []string{"203.0.113.5"}, nil,
+			"[::ffff:203.0.113.5]:40000", true},
+		{"IPv4-mapped IPv6 in CIDR", []string{"203.0.113.0/24"}, nil,
+			"[::ffff:203.0.113.9]:40000", true},
+		{"IPv4 not matching IPv6", []string{"2001:db8::/64"}, nil,
+			"203.0.113.5:1", false},
+		{"IPv4 with port", []string{"203.0.113.5:25565"}, nil,
+			"203.0.113.5:40000", true},
+		{"IPv6 with port", []string{"[2001:db8::5]:25565"}, nil,
+			"[2001:db8::5]:40000", true},
+		{"address without port", []string{"203.0.113.5"}, nil,
+			"203.0.113.5", false},
+		{"masters by default", nil, []string{"203.0.113.5",
+			"[2001:db8::5]:9999"}, "[2001:db8::5]:40000", true},
+		{"not a master", nil, []string{"203.0.113.5"}, "203.0.113.6:40000",
+			false},
+		{"masters not allowed when listed", []string{"198.51.100.1"},
+			[]string{"203.0.113.5"}, "203.0.113.5:40000", false},
+	}
+
+	t.Cleanup(func() { setAllowedControllers(nil) })
+
+	for _, test := range tests {
+		config := Config{
+			AllowedControllers: test.controllers,
+			Masters:            test.masters,
+			CommunicationsPort: "9999",
+		}
+
+		networks, err := parseControllers(config)
+		if err != nil {
+			t.Errorf("%s: failed to parse controllers: %v", test.name, err)
+			continue
+		}
+
+		setAllowedControllers(networks)
+		if controllerAllowed(test.address) != test.allowed {
+			t.Errorf("%s: controllerAllowed(%q) got %v, want %v", test.name,
+				test.address, !test.allowed, test.allowed)
+		}
+	}
+}
+
+func TestControllerAllowedLegacyMaster(t *testing.T) {
+	t.Cleanup(func() { setAllowedControllers(nil) })
+
+	networks, err := parseControllers(Config{MasterAddress: "203.0.113.5",
+		CommunicationsPort: "9999"})
+	if err != nil {
+		t.Fatal("failed to parse controllers:", err)
+	}
+
+	setAllowedControllers(networks)
+	if !controllerAllowed("203.0.113.5:40000") {
+		t.Error("expected master_address to be allowed by default")
+	}
+}
+
+func TestParseControllersInvalid(t *testing.T) {
+	tests := [][]string{
+		{"203.0.113.0/33"},
+		{"2001:db8::/129"},
+		{"203.0.113.5", "203.0.113.0/24/8"},
+	}
+
+	for _, controllers := range tests {
+		_, err := parseControllers(Config{AllowedControllers: controllers})
+		if err == nil {
+			t.Errorf("expected %q to be rejected", controllers)
+		}
+	}
+
+	if _, err := parseControllers(Config{}); err == nil {
+		t.Error("expected no controllers and no masters to be rejected")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"github.com/1lann/dynamicserver/logging"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Logs are leveled and structured, and written as text or JSON according to
+// the logging section of the configuration. With logging.directory set, they
+// are also written to a rotating backend.log in that directory.
+
+var logger = logging.New()
+var logFile *logging.RotatingWriter
+
+// configureLogging applies the logging configuration. The log directory is
+// only opened once, and changing it requires a restart.
+func configureLogging(c Config) {
+	if err := logger.Configure(c.Logging); err != nil {
+		Warn("config", "Invalid logging configuration:", err)
+	}
+
+	if logFile != nil {
+		return
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		Fatal("config", "Could not resolve filepath:", err)
+	}
+
+	logFile = c.Logging.File(dir, "backend")
+}
+
+func writeLog(level logging.Level, module string, message []interface{}) {
+	entry := logging.Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Module:  module,
+		State:   currentState,
+		Message: strings.TrimSuffix(fmt.Sprintln(message...), "\n"),
+	}
+
+	// A nil *RotatingWriter isn't a nil io.Writer.
+	if logFile != nil {
+		logger.Write(entry, logFile)
+	} else {
+		logger.Write(entry, nil)
+	}
+}
+
+func Debug(module string, message ...interface{}) {
+	writeLog(logging.LevelDebug, module, message)
+}
+
+func Log(module string, message ...interface{}) {
+	writeLog(logging.LevelInfo, module, message)
+}
+
+func Warn(module string, message ...interface{}) {
+	writeLog(logging.LevelWarn, module, message)
+}
+
+func Error(module string, message ...interface{}) {
+	writeLog(logging.LevelError, module, message)
+}
+
+func Fatal(module string, message ...interface{}) {
+	writeLog(logging.LevelError, module, message)
+	os.Exit(1)
+}
@@ -1,186 +1,213 @@
 package main
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"log"
-	"net"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"crypto/tls"
+	"fmt"
+	"github.com/1lann/dynamicserver/control"
 	"strings"
 	"time"
 )
 
 const (
-	stateStarted = "started"
-	stateStopped = "stopped"
+	stateStarted    = "started"
+	stateStopped    = "stopped"
+	stateRestarting = "restarting"
+	stateCrashed    = "crashed"
 )
 
-const version = "0.1"
+const version = "0.2"
 
 var currentState string
-var config Config
 var isStopping bool
+var tlsConfig *tls.Config
 
-type Config struct {
-	Check struct {
-		Command  string `json:"command"`
-		Contains string `json:"contains"`
-	} `json:"check"`
-	MasterAddress      string `json:"master_address"`
-	CommunicationsPort string `json:"communications_port"`
-	StartCommand       string `json:"start_command"`
-	StopCommand        string `json:"stop_command"`
-	ShutdownCommand    string `json:"shutdown_command"`
-	WorkingDirectory   string `json:"working_directory"`
-}
+// startFailure is the result of the start command if it failed, which is
+// reported to the reverse proxy with the stopped state.
+var startFailure *control.CommandResultData
 
 func main() {
-	config = loadConfig()
-	if checkState() == stateStopped {
-		startServer()
+	config := loadConfig()
+	setConfig(config, control.NewAuthenticator(config.ControlSecret))
+	configureLogging(config)
+	if !getAuth().Enabled() {
+		Warn("main", "No control_secret is set, "+
+			"the control channel is unauthenticated.")
+	}
+
+	if checkState(config) == stateStopped {
+		startServer(config)
 	}
 
-	log.Println("Initialized dynamicserver backend v" + version + ".")
+	if config.TLS.Certificate != "" {
+		tlsConfig = loadTLSConfig(config)
+	}
+
+	watchConfig()
+
+	Log("main", "Initialized dynamicserver backend v"+version+".")
 
 	go respondState()
+	go startHeartbeat()
+	go startProgressReporter()
+
+	if !supervised(config) {
+		go tailServerLog()
+	}
 
 	for {
-		newState := checkState()
+		// The configuration is read once per check, so that a reload can't
+		// change it halfway through recovering from a crash.
+		config = getConfig()
+		newState := checkState(config)
+		if crashed(newState) {
+			newState = recoverCrash(config)
+		} else if newState == stateStopped && currentState == stateCrashed &&
+			!isStopping {
+			// Stay crashed until the server is started again.
+			newState = stateCrashed
+		}
+
 		if newState != currentState {
 			currentState = newState
 			sendState()
 		}
-		time.Sleep(time.Second * 2)
+
+		select {
+		case <-stateChanged:
+		case <-time.After(time.Second * 2):
+		}
 	}
 }
 
-func loadConfig() Config {
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-	if err != nil {
-		log.Fatal(err)
-	}
+func checkState(config Config) string {
+	if supervised(config) {
+		if minecraftProcess.Running() {
+			return stateStarted
+		}
 
-	data, err := ioutil.ReadFile(dir + "/config.json")
-	if err != nil {
-		log.Fatal(err)
+		return stateStopped
 	}
 
-	var loadedConfig Config
-	err = json.Unmarshal(data, &loadedConfig)
+	result, err := config.Check.Command.run(config.WorkingDirectory)
 	if err != nil {
-		log.Fatal(err)
+		Warn("main", "Failed to run check command:", err)
 	}
 
-	return loadedConfig
-}
-
-func checkState() string {
-	checkCommand := strings.Fields(config.Check.Command)
-
-	cmd := exec.Command(checkCommand[0], checkCommand[1:]...)
-	cmd.Dir = config.WorkingDirectory
-	response, _ := cmd.Output()
-	if strings.Contains(string(response), config.Check.Contains) {
+	if strings.Contains(result.Output, config.Check.Contains) {
 		return stateStarted
 	}
 
 	return stateStopped
 }
 
-func startServer() {
-	log.Println("Executing command:", config.StartCommand)
-	runCommand := strings.Fields(config.StartCommand)
-
-	cmd := exec.Command(runCommand[0], runCommand[1:]...)
-	cmd.Dir = config.WorkingDirectory
-	_ = cmd.Start()
-}
+// startServer starts the Minecraft server, and returns an error if it could
+// not be started.
+func startServer(config Config) error {
+	isStopping = false
+	serverStartTime = time.Now()
+	setProgress(control.ProgressData{Phase: control.PhaseStarting})
 
-func stopServer() {
-	log.Println("Executing command:", config.StopCommand)
-	stopCommand := strings.Fields(config.StopCommand)
+	if supervised(config) {
+		err := minecraftProcess.Start(config)
+		if err != nil {
+			Warn("main", "Failed to start process:", err)
+		}
+		return err
+	}
 
-	cmd := exec.Command(stopCommand[0], stopCommand[1:]...)
-	cmd.Dir = config.WorkingDirectory
-	_ = cmd.Start()
-}
+	Log("main", "Executing start command:", config.StartCommand)
+	result, err := config.StartCommand.start(config.WorkingDirectory)
+	logCommandResult("start", result, err)
 
-func shutdownServer() {
-	log.Println("Executing command:", config.ShutdownCommand)
-	shutdownCommand := strings.Fields(config.ShutdownCommand)
+	if err != nil {
+		result.Output = strings.TrimSpace(result.Output + "\n" + err.Error())
+		startFailure = &result
+		return err
+	} else if result.ExitCode != nil && *result.ExitCode != 0 {
+		startFailure = &result
+		return fmt.Errorf("start command exited with code %d",
+			*result.ExitCode)
+	}
 
-	cmd := exec.Command(shutdownCommand[0], shutdownCommand[1:]...)
-	_ = cmd.Start()
+	startFailure = nil
+	return nil
 }
 
-func sendState() {
-	for i := 0; i < 3; i++ {
-		conn, err := net.Dial("tcp", config.MasterAddress+":"+
-			config.CommunicationsPort)
-		if err != nil {
-			log.Println("Could not connect to master:", err)
-			time.Sleep(time.Second)
-			continue
-		}
+// stopServer saves and stops the Minecraft server over RCON if it is
+// configured, falling back to the stop command.
+func stopServer(config Config) (control.CommandResultData, error) {
+	isStopping = true
+	signalStateChange()
+
+	if rconConfigured(config) {
+		Log("main", "Stopping server over RCON.")
+		saved, output, err := rconStop(config)
+		if err == nil {
+			if !saved {
+				Warn("main", "Could not confirm that the world saved:",
+					output)
+			}
 
-		_, err = conn.Write([]byte(currentState))
-		if err != nil {
-			log.Println("Could not send message to master:", err)
-			conn.Close()
-			time.Sleep(time.Second)
-			continue
+			return control.CommandResultData{
+				Method: "rcon",
+				Output: output,
+				Saved:  saved,
+			}, nil
 		}
 
-		conn.Close()
-		return
+		Warn("main", "Failed to stop server over RCON, falling back:", err)
 	}
-}
 
-func respondState() {
-	listener, err := net.Listen("tcp", ":"+config.CommunicationsPort)
-	if err != nil {
-		log.Fatal(err)
+	if supervised(config) {
+		Log("main", "Stopping server through the console.")
+		return control.CommandResultData{Method: "console"},
+			minecraftProcess.SendCommand("stop")
 	}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Fatal(err)
-		}
+	return runCommand(config, "stop", config.StopCommand)
+}
 
-		if conn.RemoteAddr().String() != config.MasterAddress {
-			log.Println("Received connection from unknown IP:",
-				conn.RemoteAddr().String())
-			conn.Close()
-			continue
-		}
+// runConsoleCommand runs a Minecraft console command over RCON, or writes it
+// to the console of a supervised process, in which case there is no output.
+func runConsoleCommand(config Config,
+	command string) (control.CommandResultData, error) {
+	Log("main", "Running console command:", command)
 
-		go func(conn net.Conn) {
-			defer conn.Close()
+	if !rconConfigured(config) && supervised(config) {
+		return control.CommandResultData{Method: "console"},
+			minecraftProcess.SendCommand(command)
+	}
 
-			_, err = conn.Write([]byte(currentState + "\n"))
-			if err != nil {
-				log.Println("Failed to write response:", err)
-				return
-			}
+	output, err := rconCommand(config, command)
+	return control.CommandResultData{Method: "rcon", Output: output}, err
+}
 
-			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-			command, _ := ioutil.ReadAll(conn)
-			if len(command) == 0 {
-				return
-			}
+func shutdownServer(config Config) (control.CommandResultData, error) {
+	return runCommand(config, "shutdown", config.ShutdownCommand)
+}
 
-			if string(command) == "stop" {
-				log.Println("Received request to stop.")
-				stopServer()
-			} else if string(command) == "shutdown" {
-				log.Println("Received request to shutdown.")
-				shutdownServer()
-			} else {
-				log.Println("Received unknown command:", command)
-			}
-		}(conn)
+// runCommand runs one of the configured commands in the working directory,
+// and logs its result.
+func runCommand(config Config, name string,
+	command commandSpec) (control.CommandResultData, error) {
+	Log("main", "Executing "+name+" command:", command)
+
+	result, err := command.run(config.WorkingDirectory)
+	logCommandResult(name, result, err)
+	return result, err
+}
+
+// logCommandResult logs the result of one of the configured commands, unless
+// it exited successfully.
+func logCommandResult(name string, result control.CommandResultData,
+	err error) {
+	if err != nil {
+		Warn("main", "Failed to execute "+name+" command:", err)
+	} else if result.ExitCode == nil {
+		Log("main", "The "+name+" command is still running, leaving it "+
+			"running.")
+	} else if *result.ExitCode != 0 {
+		Log("main", "The "+name+" command exited with code",
+			*result.ExitCode, "and output:", result.Output)
 	}
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/1lann/dynamicserver/control"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var defaultHeartbeatInterval = time.Second * 15
+
+type cpuSample struct {
+	idle  uint64
+	total uint64
+}
+
+var lastCPUSample cpuSample
+
+func heartbeatInterval() time.Duration {
+	config := getConfig()
+	if config.HeartbeatSeconds > 0 {
+		return time.Duration(config.HeartbeatSeconds) * time.Second
+	}
+
+	return defaultHeartbeatInterval
+}
+
+func startHeartbeat() {
+	if getConfig().LegacyProtocol {
+		return
+	}
+
+	for {
+		time.Sleep(heartbeatInterval())
+		sendHeartbeat()
+	}
+}
+
+func sendHeartbeat() {
+	data := collectMetrics()
+
+	forEachMaster(func(address string) {
+		conn, err := dialMaster(address)
+		if err != nil {
+			Warn("heartbeat", "Could not connect to master "+address+
+				" for heartbeat:", err)
+			return
+		}
+
+		master := control.NewConn(conn, getAuth())
+		defer master.Close()
+
+		message, err := control.NewMessage(control.TypeHeartbeat, data)
+		if err != nil {
+			Warn("heartbeat", "Could not create heartbeat:", err)
+			return
+		}
+
+		master.SetDeadline(time.Now().Add(time.Second * 10))
+		if _, err := master.Request(message); err != nil {
+			Warn("heartbeat", "Could not send heartbeat to master "+address+":",
+				err)
+		}
+	})
+}
+
+func collectMetrics() control.HeartbeatData {
+	data := control.HeartbeatData{
+		State:            currentState,
+		MinecraftRunning: currentState == stateStarted,
+		OnlinePlayers:    -1,
+	}
+
+	if data.MinecraftRunning {
+		online, max, err := queryPlayers()
+		if err == nil {
+			data.OnlinePlayers = online
+			data.MaxPlayers = max
+		}
+	}
+
+	data.CPUPercent = readCPUPercent()
+	data.MemoryUsed, data.MemoryTotal = readMemory()
+	data.DiskUsed, data.DiskTotal = readDisk()
+	data.UptimeSeconds = readUptime()
+
+	return data
+}
+
+// readCPUPercent returns the CPU usage since the last time it was called,
+// from /proc/stat.
+func readCPUPercent() float64 {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0
+	}
+
+	var sample cpuSample
+	for i, field := range fields[1:] {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0
+		}
+
+		sample.total += value
+		// idle and iowait
+		if i == 3 || i == 4 {
+			sample.idle += value
+		}
+	}
+
+	previous := lastCPUSample
+	lastCPUSample = sample
+
+	if previous.total == 0 || sample.total <= previous.total {
+		return 0
+	}
+
+	total := float64(sample.total - previous.total)
+	idle := float64(sample.idle - previous.idle)
+	return (total - idle) / total * 100
+}
+
+// readMemory returns the used and total memory in bytes from /proc/meminfo.
+func readMemory() (used uint64, total uint64) {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+
+	var available uint64
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		switch fields[0] {
+		case "MemTotal:":
+			total = value * 1024
+		case "MemAvailable:":
+			available = value * 1024
+		}
+	}
+
+	if available > total {
+		return 0, total
+	}
+
+	return total - available, total
+}
+
+// readDisk returns the used and total disk space in bytes of the file system
+// the working directory is on.
+func readDisk() (used uint64, total uint64) {
+	dir := getConfig().WorkingDirectory
+	if dir == "" {
+		dir = "/"
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, 0
+	}
+
+	total = stat.Blocks * uint64(stat.Bsize)
+	free := stat.Bavail * uint64(stat.Bsize)
+	return total - free, total
+}
+
+func readUptime() float64 {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+
+	uptime, _ := strconv.ParseFloat(fields[0], 64)
+	return uptime
+}
+
+func appendVarInt(data []byte, value int) []byte {
+	for value >= 0x80 {
+		data = append(data, byte(value)|0x80)
+		value >>= 7
+	}
+
+	return append(data, byte(value))
+}
+
+func readVarInt(reader io.ByteReader) (int, error) {
+	value := 0
+	for i := uint(0); i < 5; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		value |= int(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+
+	return 0, errors.New("varint too long")
+}
+
+// queryPlayers asks the local Minecraft server for its player counts with a
+// server list ping.
+func queryPlayers() (online int, max int, err error) {
+	port := getConfig().MinecraftPort
+	if port == "" {
+		port = "25565"
+	}
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+port, time.Second*2)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	portNumber, _ := strconv.Atoi(port)
+
+	// Handshake with protocol version 5 and next state 1 (status), then a
+	// status request.
+	handshake := appendVarInt([]byte{0x00}, 5)
+	handshake = appendVarInt(handshake, len("127.0.0.1"))
+	handshake = append(handshake, "127.0.0.1"...)
+	handshake = append(handshake, byte(portNumber>>8), byte(portNumber))
+	handshake = appendVarInt(handshake, 1)
+
+	request := appendVarInt(nil, len(handshake))
+	request = append(request, handshake...)
+	request = append(request, 0x01, 0x00)
+
+	if _, err := conn.Write(request); err != nil {
+		return 0, 0, err
+	}
+
+	reader := bufio.NewReader(conn)
+	if _, err := readVarInt(reader); err != nil {
+		return 0, 0, err
+	}
+
+	if packetID, err := readVarInt(reader); err != nil || packetID != 0x00 {
+		return 0, 0, errors.New("unexpected status response")
+	}
+
+	length, err := readVarInt(reader)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, 0, err
+	}
+
+	var status struct {
+		Players struct {
+			Max    int `json:"max"`
+			Online int `json:"online"`
+		} `json:"players"`
+	}
+
+	if err := json.Unmarshal(body, &status); err != nil {
+		return 0, 0, err
+	}
+
+	return status.Players.Online, status.Players.Max, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/1lann/dynamicserver/logging"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// When process.command is set, the backend runs the Minecraft server as its
+// own child process instead of through start_command and check.command. The
+// console is driven through the process' standard input, and its output is
+// written to a rotating log file.
+
+const defaultLogFile = "minecraft.log"
+
+var errNotRunning = errors.New("minecraft server is not running")
+
+type supervisedProcess struct {
+	lock     *sync.Mutex
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	running  bool
+	exitCode int
+	log      *logging.RotatingWriter
+}
+
+var minecraftProcess = &supervisedProcess{lock: &sync.Mutex{}}
+
+// stateChanged is signalled when the state may have changed, so that the
+// change can be reported without waiting for the next check.
+var stateChanged = make(chan bool, 1)
+
+func signalStateChange() {
+	select {
+	case stateChanged <- true:
+	default:
+	}
+}
+
+func supervised(config Config) bool {
+	return config.Process.Command.Configured()
+}
+
+func (p *supervisedProcess) Running() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.running
+}
+
+// ExitCode returns the exit code of the last run of the process, or -1 if it
+// was killed by a signal.
+func (p *supervisedProcess) ExitCode() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.exitCode
+}
+
+func (p *supervisedProcess) Start(config Config) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.running {
+		return nil
+	}
+
+	if p.log == nil {
+		logFile := config.Process.LogFile
+		if logFile == "" {
+			logFile = defaultLogFile
+		}
+
+		if !filepath.IsAbs(logFile) {
+			logFile = filepath.Join(config.WorkingDirectory, logFile)
+		}
+
+		p.log = logging.NewRotatingWriter(logFile,
+			int64(config.Process.LogMaxSizeMB)*1024*1024,
+			config.Process.LogMaxFiles)
+	}
+
+	command := config.Process.Command
+	cmd, err := command.prepare(context.Background(), config.WorkingDirectory)
+	if err != nil {
+		return err
+	}
+
+	output := io.MultiWriter(p.log, newLineWriter())
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	Log("process", "Starting process:", command)
+	if err := cmd.Start(); err != nil {
+		stdin.Close()
+		return err
+	}
+
+	p.cmd = cmd
+	p.stdin = stdin
+	p.running = true
+
+	go p.wait(cmd)
+
+	return nil
+}
+
+func (p *supervisedProcess) wait(cmd *exec.Cmd) {
+	err := cmd.Wait()
+
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = -1
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok &&
+			!status.Signaled() {
+			exitCode = status.ExitStatus()
+		}
+	} else if err != nil {
+		Warn("process", "Failed to wait for process:", err)
+		exitCode = -1
+	}
+
+	p.lock.Lock()
+	p.running = false
+	p.exitCode = exitCode
+	p.stdin.Close()
+	p.lock.Unlock()
+
+	Log("process", "Minecraft server exited with code", exitCode)
+	signalStateChange()
+}
+
+// SendCommand writes a console command to the process' standard input.
+func (p *supervisedProcess) SendCommand(command string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.running {
+		return errNotRunning
+	}
+
+	_, err := io.WriteString(p.stdin, command+"\n")
+	return err
+}
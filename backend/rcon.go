@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// A minimal client for the RCON protocol spoken by Minecraft servers when
+// enable-rcon is set in server.properties.
+
+const (
+	rconTypeResponse = 0
+	rconTypeCommand  = 2
+	rconTypeLogin    = 3
+
+	rconMaxPayload = 4096
+)
+
+const (
+	rconDialTimeout    = time.Second * 5
+	rconCommandTimeout = time.Second * 30
+)
+
+// rconExitWait is how long the server is given to stop accepting RCON
+// connections after the connection is lost while stopping it.
+var rconExitWait = time.Second * 30
+
+var (
+	errRCONNotConfigured = errors.New("rcon: not configured")
+	errRCONAuthFailed    = errors.New("rcon: authentication failed")
+	errRCONBadResponse   = errors.New("rcon: malformed response")
+)
+
+type rconClient struct {
+	conn      net.Conn
+	requestID int32
+}
+
+func rconConfigured(config Config) bool {
+	return config.RCON.Address != ""
+}
+
+func dialRCON(config Config) (*rconClient, error) {
+	if !rconConfigured(config) {
+		return nil, errRCONNotConfigured
+	}
+
+	conn, err := net.DialTimeout("tcp", config.RCON.Address, rconDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &rconClient{conn: conn}
+
+	conn.SetDeadline(time.Now().Add(rconDialTimeout))
+	id, err := client.send(rconTypeLogin, config.RCON.Password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	responseID, _, err := client.receive()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// A failed login is answered with a request ID of -1.
+	if responseID != id {
+		conn.Close()
+		return nil, errRCONAuthFailed
+	}
+
+	return client, nil
+}
+
+func (c *rconClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *rconClient) send(packetType int32, body string) (int32, error) {
+	c.requestID++
+
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.LittleEndian, int32(len(body)+10))
+	binary.Write(&packet, binary.LittleEndian, c.requestID)
+	binary.Write(&packet, binary.LittleEndian, packetType)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+
+	_, err := c.conn.Write(packet.Bytes())
+	return c.requestID, err
+}
+
+func (c *rconClient) receive() (int32, string, error) {
+	var header struct {
+		Length    int32
+		RequestID int32
+		Type      int32
+	}
+
+	if err := binary.Read(c.conn, binary.LittleEndian, &header); err != nil {
+		return 0, "", err
+	}
+
+	if header.Length < 10 || header.Length > rconMaxPayload+10 {
+		return 0, "", errRCONBadResponse
+	}
+
+	body := make([]byte, header.Length-8)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return 0, "", err
+	}
+
+	return header.RequestID, string(bytes.TrimRight(body, "\x00")), nil
+}
+
+// Command runs a console command and returns its output.
+func (c *rconClient) Command(command string) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(rconCommandTimeout))
+
+	id, err := c.send(rconTypeCommand, command)
+	if err != nil {
+		return "", err
+	}
+
+	return c.reply(id)
+}
+
+// reply receives the output of the command with the request ID.
+func (c *rconClient) reply(id int32) (string, error) {
+	responseID, output, err := c.receive()
+	if err != nil {
+		return "", err
+	}
+
+	if responseID != id {
+		return "", errRCONBadResponse
+	}
+
+	return output, nil
+}
+
+// rconCommand runs a single console command over a new RCON connection.
+func rconCommand(config Config, command string) (string, error) {
+	client, err := dialRCON(config)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	return client.Command(command)
+}
+
+// rconStop saves the world and stops the server over RCON. It returns
+// whether the save was confirmed, and the output of both commands.
+func rconStop(config Config) (bool, string, error) {
+	client, err := dialRCON(config)
+	if err != nil {
+		return false, "", err
+	}
+	defer client.Close()
+
+	saveOutput, err := client.Command("save-all flush")
+	if err != nil {
+		return false, "", err
+	}
+
+	saved := strings.Contains(strings.ToLower(saveOutput), "saved")
+
+	client.conn.SetDeadline(time.Now().Add(rconCommandTimeout))
+	id, err := client.send(rconTypeCommand, "stop")
+	if err != nil {
+		return saved, saveOutput, err
+	}
+
+	stopOutput, err := client.reply(id)
+	if err != nil {
+		// The server may close or reset the connection as it stops, before
+		// replying. Once stop was sent, that only counts as a failure if
+		// the server isn't exiting.
+		if !serverExiting(config) {
+			return saved, saveOutput, err
+		}
+
+		Log("rcon", "Lost the RCON connection while stopping, but the "+
+			"server is exiting:", err)
+	}
+
+	return saved, strings.TrimSpace(saveOutput + "\n" + stopOutput), nil
+}
+
+// serverExiting returns whether the Minecraft server is exiting, waiting up
+// to rconExitWait for it to stop accepting RCON connections, or for its
+// process to exit if it is supervised.
+func serverExiting(config Config) bool {
+	deadline := time.Now().Add(rconExitWait)
+	for {
+		if supervised(config) && !minecraftProcess.Running() {
+			return true
+		}
+
+		conn, err := net.DialTimeout("tcp", config.RCON.Address,
+			rconDialTimeout)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(time.Millisecond * 200)
+	}
+}
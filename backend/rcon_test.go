@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeRCON is a Minecraft server's RCON listener, which answers the stop
+// command with stop.
+type fakeRCON struct {
+	listener net.Listener
+	stop     func(conn *net.TCPConn, id int32)
+}
+
+func writeRCONPacket(conn net.Conn, id int32, body string) {
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.LittleEndian, int32(len(body)+10))
+	binary.Write(&packet, binary.LittleEndian, id)
+	binary.Write(&packet, binary.LittleEndian, int32(rconTypeResponse))
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+	conn.Write(packet.Bytes())
+}
+
+func (r *fakeRCON) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go r.handle(conn.(*net.TCPConn))
+	}
+}
+
+func (r *fakeRCON) handle(conn *net.TCPConn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	for {
+		var header struct {
+			Length    int32
+			RequestID int32
+			Type      int32
+		}
+
+		if binary.Read(conn, binary.LittleEndian, &header) != nil {
+			return
+		}
+
+		body := make([]byte, header.Length-8)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		switch string(bytes.TrimRight(body, "\x00")) {
+		case "stop":
+			r.stop(conn, header.RequestID)
+			return
+		case "save-all flush":
+			writeRCONPacket(conn, header.RequestID, "Saved the game")
+		default:
+			// Logins, with any password.
+			writeRCONPacket(conn, header.RequestID, "")
+		}
+	}
+}
+
+func TestRCONStop(t *testing.T) {
+	rconExitWait = time.Millisecond * 500
+
+	tests := []struct {
+		name string
+		stop func(r *fakeRCON, conn *net.TCPConn, id int32)
+		// exits is whether the server stops listening after stop.
+		exits  bool
+		output string
+	}{
+		{
+			name: "replies",
+			stop: func(r *fakeRCON, conn *net.TCPConn, id int32) {
+				writeRCONPacket(conn, id, "Stopping the server")
+				r.listener.Close()
+			},
+			exits:  true,
+			output: "Saved the game\nStopping the server",
+		},
+		{
+			name: "closes the connection",
+			stop: func(r *fakeRCON, conn *net.TCPConn, id int32) {
+				r.listener.Close()
+			},
+			exits:  true,
+			output: "Saved the game",
+		},
+		{
+			name: "resets the connection",
+			stop: func(r *fakeRCON, conn *net.TCPConn, id int32) {
+				r.listener.Close()
+				conn.SetLinger(0)
+			},
+			exits:  true,
+			output: "Saved the game",
+		},
+		{
+			name: "closes the connection and keeps running",
+			stop: func(r *fakeRCON, conn *net.TCPConn, id int32) {},
+		},
+	}
+
+	for _, test := range tests {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("failed to listen:", err)
+		}
+
+		rcon := &fakeRCON{listener: listener}
+		rcon.stop = func(conn *net.TCPConn, id int32) {
+			test.stop(rcon, conn, id)
+		}
+		go rcon.serve()
+
+		var config Config
+		config.RCON.Address = listener.Addr().String()
+
+		saved, output, err := rconStop(config)
+		listener.Close()
+
+		if !test.exits {
+			if err == nil {
+				t.Errorf("%s: expected stopping to fail", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: failed to stop: %v", test.name, err)
+			continue
+		}
+
+		if !saved || output != test.output {
+			t.Errorf("%s: got saved %v with output %q, want %q", test.name,
+				saved, output, test.output)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/1lann/dynamicserver/control"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The backend follows the Minecraft server's log to tell how far along it is
+// in starting up, and pushes each phase to the reverse proxy. A supervised
+// process' output is read directly, otherwise server_log is tailed.
+
+const defaultServerLog = "logs/latest.log"
+
+const maxLogLineLength = 4096
+
+var (
+	preparingLevelPattern = regexp.MustCompile(`Preparing level "`)
+	preparingSpawnPattern = regexp.MustCompile(
+		`Preparing (?:spawn area|start region).*?(?:: (\d+)%)?\s*$`)
+	donePattern = regexp.MustCompile(`Done \(([0-9.]+)s\)!`)
+)
+
+var progressLock = &sync.Mutex{}
+var currentProgress control.ProgressData
+var progressChanged = make(chan bool, 1)
+
+// setProgress records the startup phase, and queues it to be sent to the
+// reverse proxy if it changed.
+func setProgress(progress control.ProgressData) {
+	progressLock.Lock()
+	if progress == currentProgress {
+		progressLock.Unlock()
+		return
+	}
+
+	if progress.Phase != currentProgress.Phase {
+		Log("readiness", "Minecraft server startup phase:", progress.Phase)
+	}
+
+	currentProgress = progress
+	progressLock.Unlock()
+
+	select {
+	case progressChanged <- true:
+	default:
+	}
+}
+
+func getProgress() control.ProgressData {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	return currentProgress
+}
+
+// observeLogLine updates the startup phase from a line of the server log.
+func observeLogLine(line string) {
+	if match := donePattern.FindStringSubmatch(line); match != nil {
+		seconds, _ := strconv.ParseFloat(match[1], 64)
+		setProgress(control.ProgressData{
+			Phase:   control.PhaseReady,
+			Seconds: seconds,
+		})
+		return
+	}
+
+	if match := preparingSpawnPattern.FindStringSubmatch(line); match != nil {
+		percent, _ := strconv.Atoi(match[1])
+		setProgress(control.ProgressData{
+			Phase:   control.PhasePreparingSpawn,
+			Percent: percent,
+		})
+		return
+	}
+
+	if preparingLevelPattern.MatchString(line) {
+		setProgress(control.ProgressData{Phase: control.PhasePreparingLevel})
+	}
+}
+
+// startProgressReporter sends startup phases to the reverse proxy as they
+// change. Only the most recent phase is sent if several change at once.
+func startProgressReporter() {
+	if getConfig().LegacyProtocol {
+		return
+	}
+
+	for range progressChanged {
+		sendProgress(getProgress())
+	}
+}
+
+func sendProgress(progress control.ProgressData) {
+	forEachMaster(func(address string) {
+		conn, err := dialMaster(address)
+		if err != nil {
+			Warn("readiness", "Could not connect to master "+address+
+				" for progress:", err)
+			return
+		}
+
+		master := control.NewConn(conn, getAuth())
+		defer master.Close()
+
+		message, err := control.NewMessage(control.TypeProgress, progress)
+		if err != nil {
+			Warn("readiness", "Could not create progress:", err)
+			return
+		}
+
+		master.SetDeadline(time.Now().Add(time.Second * 10))
+		if _, err := master.Request(message); err != nil {
+			Warn("readiness", "Could not send progress to master "+address+":",
+				err)
+		}
+	})
+}
+
+// lineWriter calls observeLogLine for every line written to it.
+type lineWriter struct {
+	lock    *sync.Mutex
+	partial []byte
+}
+
+func newLineWriter() *lineWriter {
+	return &lineWriter{lock: &sync.Mutex{}}
+}
+
+func (w *lineWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.partial = append(w.partial, data...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		observeLogLine(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+
+	if len(w.partial) > maxLogLineLength {
+		w.partial = nil
+	}
+
+	return len(data), nil
+}
+
+func serverLogPath() string {
+	config := getConfig()
+	path := config.ServerLog
+	if path == "" {
+		path = defaultServerLog
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(config.WorkingDirectory, path)
+	}
+
+	return path
+}
+
+// tailServerLog follows the server log, reopening it from the start when the
+// Minecraft server replaces it on startup.
+func tailServerLog() {
+	path := serverLogPath()
+
+	var file *os.File
+	var reader *bufio.Reader
+	var partial string
+
+	// Lines written before the backend started have already happened.
+	if existing, err := os.Open(path); err == nil {
+		existing.Seek(0, io.SeekEnd)
+		file = existing
+		reader = bufio.NewReader(file)
+	}
+
+	for {
+		if file != nil {
+			for {
+				// Partial lines are kept until the rest is written.
+				line, err := reader.ReadString('\n')
+				partial += line
+				if err != nil {
+					break
+				}
+
+				observeLogLine(partial)
+				partial = ""
+			}
+		}
+
+		time.Sleep(time.Second)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if file != nil {
+			current, err := file.Stat()
+			offset, _ := file.Seek(0, io.SeekCurrent)
+			if err == nil && os.SameFile(info, current) &&
+				info.Size() >= offset {
+				continue
+			}
+
+			file.Close()
+		}
+
+		file, err = os.Open(path)
+		if err != nil {
+			file = nil
+			continue
+		}
+
+		reader = bufio.NewReader(file)
+		partial = ""
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// When crash_recovery is enabled, the backend restarts the Minecraft server
+// when it stops without being asked to. Restarts are delayed with an
+// exponential backoff, and once more than max_restarts happen within the
+// window the server is left in the crashed state for someone to look at.
+
+const (
+	defaultMaxRestarts       = 3
+	defaultRestartWindow     = time.Minute * 30
+	defaultRestartBackoff    = time.Second * 10
+	defaultMaxRestartBackoff = time.Minute * 5
+
+	maxCrashReportSize = 64 * 1024
+)
+
+var serverStartTime time.Time
+var restartTimes []time.Time
+
+// retryingRestart is whether the server is crashed because restarting it
+// failed, and will be restarted again.
+var retryingRestart bool
+
+// crashReport and crashReportFile are the most recent crash report, which is
+// sent to the reverse proxy with the restarting and crashed states.
+var crashReport string
+var crashReportFile string
+
+func maxRestarts(config Config) int {
+	if config.CrashRecovery.MaxRestarts > 0 {
+		return config.CrashRecovery.MaxRestarts
+	}
+
+	return defaultMaxRestarts
+}
+
+func restartWindow(config Config) time.Duration {
+	if config.CrashRecovery.WindowMinutes > 0 {
+		return time.Duration(config.CrashRecovery.WindowMinutes) *
+			time.Minute
+	}
+
+	return defaultRestartWindow
+}
+
+// restartBackoff returns how long to wait before the next restart, doubling
+// with every restart within the window.
+func restartBackoff(config Config, restarts int) time.Duration {
+	backoff := defaultRestartBackoff
+	if config.CrashRecovery.BackoffSeconds > 0 {
+		backoff = time.Duration(config.CrashRecovery.BackoffSeconds) *
+			time.Second
+	}
+
+	maxBackoff := defaultMaxRestartBackoff
+	if config.CrashRecovery.MaxBackoffSeconds > 0 {
+		maxBackoff = time.Duration(config.CrashRecovery.MaxBackoffSeconds) *
+			time.Second
+	}
+
+	for i := 0; i < restarts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+
+	return backoff
+}
+
+// crashed returns whether the server stopping should be treated as a crash,
+// which is whenever it stops without the reverse proxy asking it to.
+func crashed(newState string) bool {
+	return newState == stateStopped && !isStopping &&
+		(currentState == stateStarted || currentState == stateRestarting)
+}
+
+// recoverCrash handles the Minecraft server having crashed, and returns the
+// state to report. If the restart budget isn't used up yet, the server is
+// restarted after a backoff. A restart which fails is reported as crashed,
+// and tried again after a longer backoff until the budget is used up.
+func recoverCrash(config Config) string {
+	crashReportFile, crashReport = readCrashReport(config)
+	if crashReportFile != "" {
+		Log("recovery", "Minecraft server crashed, crash report:",
+			crashReportFile)
+	} else {
+		Log("recovery", "Minecraft server stopped unexpectedly.")
+	}
+
+	if !config.CrashRecovery.Enabled {
+		return stateStopped
+	}
+
+	for {
+		window := time.Now().Add(-restartWindow(config))
+		for len(restartTimes) > 0 && restartTimes[0].Before(window) {
+			restartTimes = restartTimes[1:]
+		}
+
+		if len(restartTimes) >= maxRestarts(config) {
+			Error("recovery", "Restarted", len(restartTimes), "times within",
+				restartWindow(config).String()+", giving up.")
+			retryingRestart = false
+			return stateCrashed
+		}
+
+		backoff := restartBackoff(config, len(restartTimes))
+		restartTimes = append(restartTimes, time.Now())
+
+		currentState = stateRestarting
+		sendState()
+
+		Log("recovery", "Restarting Minecraft server in", backoff.String()+".")
+		time.Sleep(backoff)
+
+		if isStopping {
+			Log("recovery", "Not restarting, as the server is being stopped.")
+			return stateStopped
+		}
+
+		err := startServer(config)
+		if err == nil {
+			if state := checkState(config); state != stateStopped {
+				return state
+			}
+
+			err = errNotRunning
+		}
+
+		Warn("recovery", "Failed to restart Minecraft server:", err)
+		retryingRestart = true
+		currentState = stateCrashed
+		sendState()
+	}
+}
+
+// readCrashReport returns the name and contents of the newest crash report
+// written since the server was started, if there is one.
+func readCrashReport(config Config) (string, string) {
+	dir := filepath.Join(config.WorkingDirectory, "crash-reports")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", ""
+	}
+
+	var newest os.FileInfo
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".txt") ||
+			file.ModTime().Before(serverStartTime) {
+			continue
+		}
+
+		if newest == nil || file.ModTime().After(newest.ModTime()) {
+			newest = file
+		}
+	}
+
+	if newest == nil {
+		return "", ""
+	}
+
+	file, err := os.Open(filepath.Join(dir, newest.Name()))
+	if err != nil {
+		Warn("recovery", "Failed to read crash report:", err)
+		return newest.Name(), ""
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxCrashReportSize))
+	if err != nil {
+		Warn("recovery", "Failed to read crash report:", err)
+	}
+
+	return newest.Name(), string(data)
+}
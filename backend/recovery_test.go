@@ -0,0 +1,163 @@
+package main
+
+import (
+	"github.com/1lann/dynamicserver/control"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMaster records the states reported to it by the backend.
+type fakeMaster struct {
+	lock   *sync.Mutex
+	states []control.StateData
+}
+
+func (m *fakeMaster) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		master := control.NewConn(conn, getAuth())
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+		message, err := master.Receive()
+		if err == nil {
+			var data control.StateData
+			message.Decode(&data)
+
+			m.lock.Lock()
+			m.states = append(m.states, data)
+			m.lock.Unlock()
+
+			ack, _ := message.Ack(nil)
+			master.Send(ack)
+		}
+
+		conn.Close()
+	}
+}
+
+// recoveryConfig returns a configuration with crash recovery enabled, which
+// reports to a fake master. The start command is run with the number of its
+// run as $1, and it starts the server if it exits with code 0, so that the
+// check command finds it running.
+func recoveryConfig(t *testing.T, startCommand string) (Config,
+	*fakeMaster) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	master := &fakeMaster{lock: &sync.Mutex{}}
+
+	dir := t.TempDir()
+	config := Config{
+		Masters:          []string{listener.Addr().String()},
+		WorkingDirectory: dir,
+	}
+	config.StartCommand = commandSpec{Args: []string{"/bin/sh", "-c",
+		"echo >> runs; set -- $(wc -l < runs); " + startCommand +
+			" && touch running"}}
+	config.Check.Command = commandSpec{Args: []string{"ls"}}
+	config.Check.Contains = "running"
+	config.CrashRecovery.Enabled = true
+	config.CrashRecovery.MaxRestarts = 3
+	config.CrashRecovery.BackoffSeconds = 1
+	config.CrashRecovery.MaxBackoffSeconds = 1
+
+	setConfig(config, control.NewAuthenticator("secret"))
+	go master.serve(listener)
+
+	restartTimes = nil
+	retryingRestart = false
+	startFailure = nil
+	currentState = stateStarted
+	isStopping = false
+	t.Cleanup(func() { restartTimes = nil })
+
+	return config, master
+}
+
+// reported returns the states reported to the master, with the number of
+// restarts and whether they would be retried.
+func (m *fakeMaster) reported() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var states []string
+	for _, data := range m.states {
+		state := data.State
+		if data.RetryingRestart {
+			state += " retrying"
+		}
+
+		states = append(states, state)
+	}
+
+	return states
+}
+
+func TestRecoverCrashRestartFails(t *testing.T) {
+	config, master := recoveryConfig(t, "echo failed; exit 3")
+
+	if state := recoverCrash(config); state != stateCrashed {
+		t.Fatalf("expected state %q, but got %q", stateCrashed, state)
+	}
+
+	// Every failed restart is reported, and the backend keeps trying until
+	// it has restarted max_restarts times.
+	want := []string{
+		stateRestarting, stateCrashed + " retrying",
+		stateRestarting, stateCrashed + " retrying",
+		stateRestarting, stateCrashed + " retrying",
+	}
+	if got := master.reported(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got states %q reported, want %q", got, want)
+	}
+
+	if len(restartTimes) != 3 {
+		t.Errorf("got %d restarts, want 3", len(restartTimes))
+	}
+
+	master.lock.Lock()
+	failure := master.states[len(master.states)-1].StartFailure
+	master.lock.Unlock()
+	if failure == nil || failure.ExitCode == nil || *failure.ExitCode != 3 ||
+		failure.Output != "failed\n" {
+		t.Errorf("got start failure %+v reported, want exit code 3",
+			failure)
+	}
+
+	// Once given up, the server stays crashed without retrying.
+	currentState = stateCrashed
+	sendState()
+	if got := master.reported(); got[len(got)-1] != stateCrashed {
+		t.Errorf("got %q reported after giving up, want %q",
+			got[len(got)-1], stateCrashed)
+	}
+}
+
+func TestRecoverCrashRestartSucceedsLater(t *testing.T) {
+	// The second restart succeeds.
+	config, master := recoveryConfig(t, "test $1 -ge 2")
+
+	if state := recoverCrash(config); state != stateStarted {
+		t.Fatalf("expected state %q, but got %q", stateStarted, state)
+	}
+
+	want := []string{stateRestarting, stateCrashed + " retrying",
+		stateRestarting}
+	if got := master.reported(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got states %q reported, want %q", got, want)
+	}
+
+	if startFailure != nil {
+		t.Errorf("expected no start failure, but got %+v", startFailure)
+	}
+}
@@ -0,0 +1,130 @@
+// Package control contains the pieces of the control channel protocol
+// shared between the reverse proxy and the backend.
+package control
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxClockSkew is how far a message's timestamp may be from the local clock
+// for it to be accepted.
+const MaxClockSkew = time.Second * 30
+
+var (
+	ErrMalformed = errors.New("control: malformed signed message")
+	ErrSignature = errors.New("control: invalid signature")
+	ErrExpired   = errors.New("control: message timestamp out of range")
+	ErrReplayed  = errors.New("control: message nonce already used")
+)
+
+// Authenticator signs and verifies control messages with an HMAC-SHA256 of
+// a shared secret. A signed message has the form
+// "<message> <unix timestamp> <nonce> <hex signature>". Nonces are
+// remembered for as long as their timestamp is valid so that messages cannot
+// be replayed.
+//
+// An Authenticator with an empty secret is disabled, and passes messages
+// through unchanged.
+type Authenticator struct {
+	secret []byte
+	lock   *sync.Mutex
+	seen   map[string]time.Time
+}
+
+func NewAuthenticator(secret string) *Authenticator {
+	return &Authenticator{
+		secret: []byte(secret),
+		lock:   &sync.Mutex{},
+		seen:   make(map[string]time.Time),
+	}
+}
+
+func (a *Authenticator) Enabled() bool {
+	return len(a.secret) > 0
+}
+
+func (a *Authenticator) mac(message, timestamp, nonce string) string {
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(message + "|" + timestamp + "|" + nonce))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Sign returns the signed form of message, which must not contain newlines.
+func (a *Authenticator) Sign(message string) string {
+	if !a.Enabled() {
+		return message
+	}
+
+	nonceBytes := make([]byte, 12)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		panic("control: failed to generate nonce: " + err.Error())
+	}
+
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	return message + " " + timestamp + " " + nonce + " " +
+		a.mac(message, timestamp, nonce)
+}
+
+// Verify checks the signature, timestamp and nonce of a signed message, and
+// returns the original message.
+func (a *Authenticator) Verify(signed string) (string, error) {
+	if !a.Enabled() {
+		return signed, nil
+	}
+
+	parts := make([]string, 3)
+	rest := signed
+	for i := 2; i >= 0; i-- {
+		index := strings.LastIndex(rest, " ")
+		if index < 0 {
+			return "", ErrMalformed
+		}
+
+		parts[i] = rest[index+1:]
+		rest = rest[:index]
+	}
+
+	timestamp, nonce, signature := parts[0], parts[1], parts[2]
+
+	if !hmac.Equal([]byte(signature), []byte(a.mac(rest, timestamp, nonce))) {
+		return "", ErrSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	sent := time.Unix(unix, 0)
+	if sent.Before(time.Now().Add(-MaxClockSkew)) ||
+		sent.After(time.Now().Add(MaxClockSkew)) {
+		return "", ErrExpired
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for seenNonce, expiry := range a.seen {
+		if time.Now().After(expiry) {
+			delete(a.seen, seenNonce)
+		}
+	}
+
+	if _, found := a.seen[nonce]; found {
+		return "", ErrReplayed
+	}
+
+	a.seen[nonce] = sent.Add(MaxClockSkew)
+
+	return rest, nil
+}
@@ -0,0 +1,147 @@
+package control
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signAt signs message like Sign, but with the given time and nonce.
+func signAt(a *Authenticator, message string, at time.Time,
+	nonce string) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return message + " " + timestamp + " " + nonce + " " +
+		a.mac(message, timestamp, nonce)
+}
+
+func TestVerify(t *testing.T) {
+	auth := NewAuthenticator("secret")
+	other := NewAuthenticator("other secret")
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		signed  string
+		message string
+		err     error
+	}{
+		{
+			name:    "signed",
+			signed:  auth.Sign("started"),
+			message: "started",
+		},
+		{
+			name:    "message with spaces",
+			signed:  auth.Sign(`{"type": "state", "data": "a b c"}`),
+			message: `{"type": "state", "data": "a b c"}`,
+		},
+		{
+			name:    "empty message",
+			signed:  auth.Sign(""),
+			message: "",
+		},
+		{
+			name:    "within clock skew",
+			signed:  signAt(auth, "started", now.Add(-MaxClockSkew/2), "a"),
+			message: "started",
+		},
+		{
+			name:   "unsigned",
+			signed: "started",
+			err:    ErrMalformed,
+		},
+		{
+			name:   "other secret",
+			signed: other.Sign("started"),
+			err:    ErrSignature,
+		},
+		{
+			name: "tampered message",
+			signed: "stopped" + strings.TrimPrefix(auth.Sign("started"),
+				"started"),
+			err: ErrSignature,
+		},
+		{
+			name:   "tampered signature",
+			signed: auth.Sign("started") + "0",
+			err:    ErrSignature,
+		},
+		{
+			name:   "invalid timestamp",
+			signed: "started now b " + auth.mac("started", "now", "b"),
+			err:    ErrMalformed,
+		},
+		{
+			name:   "too old",
+			signed: signAt(auth, "started", now.Add(-MaxClockSkew*2), "c"),
+			err:    ErrExpired,
+		},
+		{
+			name:   "too new",
+			signed: signAt(auth, "started", now.Add(MaxClockSkew*2), "d"),
+			err:    ErrExpired,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := auth.Verify(test.signed)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+
+			if message != test.message {
+				t.Errorf("got message %q, want %q", message, test.message)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	auth := NewAuthenticator("secret")
+
+	signed := auth.Sign("stop")
+	if _, err := auth.Verify(signed); err != nil {
+		t.Fatal("first verify failed:", err)
+	}
+
+	if _, err := auth.Verify(signed); err != ErrReplayed {
+		t.Fatalf("got error %v for a replay, want %v", err, ErrReplayed)
+	}
+
+	// Nonces are per message, not per content.
+	if _, err := auth.Verify(auth.Sign("stop")); err != nil {
+		t.Fatal("verifying a new message failed:", err)
+	}
+
+	// The nonce of a message which was rejected isn't remembered.
+	rejected := signAt(auth, "stop", time.Now().Add(-MaxClockSkew*2), "e")
+	if _, err := auth.Verify(rejected); err != ErrExpired {
+		t.Fatalf("got error %v, want %v", err, ErrExpired)
+	}
+
+	if _, err := auth.Verify(signAt(auth, "stop", time.Now(),
+		"e")); err != nil {
+		t.Fatal("verifying with the rejected nonce failed:", err)
+	}
+}
+
+func TestDisabledAuthenticator(t *testing.T) {
+	auth := NewAuthenticator("")
+	if auth.Enabled() {
+		t.Fatal("authenticator without a secret is enabled")
+	}
+
+	if signed := auth.Sign("started"); signed != "started" {
+		t.Errorf("got %q from Sign, want the message unchanged", signed)
+	}
+
+	for i := 0; i < 2; i++ {
+		message, err := auth.Verify("started")
+		if err != nil || message != "started" {
+			t.Errorf("got %q, %v from Verify, want the message unchanged",
+				message, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package control
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// ProtocolVersion is the version of the control protocol spoken by this
+// package. Version 0 is the legacy protocol of bare strings, such as
+// "started" and "stop", without acknowledgements.
+const ProtocolVersion = 1
+
+// Message types.
+const (
+	// TypeHello is sent by the backend when the reverse proxy connects to
+	// it, and carries StateData.
+	TypeHello = "hello"
+	// TypeState is sent by the backend when its state changes, and carries
+	// StateData.
+	TypeState = "state"
+	// TypeHeartbeat is sent periodically by the backend, and carries
+	// HeartbeatData.
+	TypeHeartbeat = "heartbeat"
+	// TypeProgress is sent by the backend as the Minecraft server starts
+	// up, and carries ProgressData.
+	TypeProgress = "progress"
+	// TypeStop asks the backend to stop the Minecraft server. It is
+	// acknowledged with CommandResultData.
+	TypeStop = "stop"
+	// TypeCommand asks the backend to run a Minecraft console command, and
+	// carries CommandData. It is acknowledged with CommandResultData.
+	TypeCommand = "command"
+	// TypeShutdown asks the backend to shut down the machine. It is
+	// acknowledged with CommandResultData.
+	TypeShutdown = "shutdown"
+	// TypeAck acknowledges a request, and may carry data in response.
+	TypeAck = "ack"
+	// TypeError rejects a request.
+	TypeError = "error"
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("control: unsupported protocol " +
+		"version")
+	ErrUnexpectedReply = errors.New("control: unexpected reply")
+)
+
+// Message is a single message of the control protocol, sent as a line of
+// JSON.
+type Message struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	ReplyTo string          `json:"reply_to,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// StateData is the data of TypeHello and TypeState messages.
+type StateData struct {
+	// State is one of "started", "stopped", "restarting" after a crash, or
+	// "crashed" if restarting it failed or the backend gave up restarting it.
+	State string `json:"state"`
+	// ExitCode is the exit code of the Minecraft server process when it is
+	// stopped, if it is known. It is -1 if the process was killed.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// CrashReport is the contents of the crash report written by the
+	// Minecraft server, if any, when the state is "restarting" or "crashed".
+	CrashReport     string `json:"crash_report,omitempty"`
+	CrashReportFile string `json:"crash_report_file,omitempty"`
+	// Restarts is the number of times the backend restarted the Minecraft
+	// server recently.
+	Restarts int `json:"restarts,omitempty"`
+	// RetryingRestart is whether the backend will try restarting the
+	// server again when the state is "crashed", as the last restart failed.
+	RetryingRestart bool `json:"retrying_restart,omitempty"`
+	// StartFailure is the result of the start command, if it failed.
+	StartFailure *CommandResultData `json:"start_failure,omitempty"`
+	// StopTimeoutSeconds and ShutdownTimeoutSeconds are how long the
+	// backend may take to reply to TypeStop and TypeShutdown requests. They
+	// are only sent with TypeHello.
+	StopTimeoutSeconds     int `json:"stop_timeout_seconds,omitempty"`
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds,omitempty"`
+}
+
+// HeartbeatData is the data of TypeHeartbeat messages. Fields which could
+// not be measured are left zero, or -1 for OnlinePlayers.
+type HeartbeatData struct {
+	State            string  `json:"state"`
+	MinecraftRunning bool    `json:"minecraft_running"`
+	OnlinePlayers    int     `json:"online_players"`
+	MaxPlayers       int     `json:"max_players"`
+	CPUPercent       float64 `json:"cpu_percent"`
+	MemoryUsed       uint64  `json:"memory_used"`
+	MemoryTotal      uint64  `json:"memory_total"`
+	DiskUsed         uint64  `json:"disk_used"`
+	DiskTotal        uint64  `json:"disk_total"`
+	UptimeSeconds    float64 `json:"uptime_seconds"`
+}
+
+// Startup phases of the Minecraft server, as reported in ProgressData.
+const (
+	PhaseStarting       = "starting"
+	PhasePreparingLevel = "preparing_level"
+	PhasePreparingSpawn = "preparing_spawn"
+	PhaseReady          = "ready"
+)
+
+// ProgressData is the data of TypeProgress messages.
+type ProgressData struct {
+	Phase string `json:"phase"`
+	// Percent is how far along preparing the spawn area is.
+	Percent int `json:"percent,omitempty"`
+	// Seconds is how long the Minecraft server reported it took to start,
+	// once it is ready.
+	Seconds float64 `json:"seconds,omitempty"`
+}
+
+// CommandData is the data of TypeCommand messages.
+type CommandData struct {
+	Command string `json:"command"`
+}
+
+// CommandResultData is the data of acknowledgements to TypeStop and
+// TypeCommand messages.
+type CommandResultData struct {
+	// Method is how the command was run, either "rcon", "console" for the
+	// standard input of a supervised process, or "command" for the
+	// configured stop command.
+	Method string `json:"method"`
+	Output string `json:"output,omitempty"`
+	// Saved is whether the world was confirmed to be saved before stopping.
+	Saved bool `json:"saved,omitempty"`
+	// ExitCode is the exit code of the configured command, -1 if it was
+	// killed by a signal.
+	ExitCode *int `json:"exit_code,omitempty"`
+}
+
+// RemoteError is an error reply received from the other side.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "control: remote error: " + e.Message
+}
+
+func newID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic("control: failed to generate message ID: " + err.Error())
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// NewMessage creates a message of the given type, with data encoded as JSON
+// if it isn't nil.
+func NewMessage(messageType string, data interface{}) (Message, error) {
+	message := Message{
+		Version: ProtocolVersion,
+		Type:    messageType,
+		ID:      newID(),
+	}
+
+	if data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return Message{}, err
+		}
+
+		message.Data = encoded
+	}
+
+	return message, nil
+}
+
+// Ack creates an acknowledgement of the message, with optional data.
+func (m Message) Ack(data interface{}) (Message, error) {
+	reply, err := NewMessage(TypeAck, data)
+	reply.ReplyTo = m.ID
+	return reply, err
+}
+
+// Reject creates an error reply to the message.
+func (m Message) Reject(reason string) Message {
+	reply, _ := NewMessage(TypeError, nil)
+	reply.ReplyTo = m.ID
+	reply.Error = reason
+	return reply
+}
+
+// Decode decodes the message's data into value.
+func (m Message) Decode(value interface{}) error {
+	if len(m.Data) == 0 {
+		return errors.New("control: message has no data")
+	}
+
+	return json.Unmarshal(m.Data, value)
+}
+
+// ParseMessage parses a line as a message. It returns false if the line is
+// not a message, such as if it is from the legacy protocol.
+func ParseMessage(line string) (Message, bool) {
+	if !strings.HasPrefix(line, "{") {
+		return Message{}, false
+	}
+
+	var message Message
+	if err := json.Unmarshal([]byte(line), &message); err != nil {
+		return Message{}, false
+	}
+
+	if message.Type == "" {
+		return Message{}, false
+	}
+
+	return message, true
+}
+
+// LegacyMessage converts a message of the legacy protocol into a message.
+// Legacy states become TypeState messages, and anything else becomes a
+// message of that type.
+func LegacyMessage(line string) Message {
+	switch line {
+	case "started", "stopped":
+		data, _ := json.Marshal(StateData{State: line})
+		return Message{Version: 0, Type: TypeState, Data: data}
+	}
+
+	return Message{Version: 0, Type: line}
+}
+
+// Conn is a control connection, on which every line is signed by an
+// Authenticator.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	auth   *Authenticator
+}
+
+func NewConn(conn net.Conn, auth *Authenticator) *Conn {
+	return &Conn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		auth:   auth,
+	}
+}
+
+// ReadLine reads and verifies a line. Legacy peers close the connection
+// instead of ending their line, so a final line without a newline is also
+// returned.
+func (c *Conn) ReadLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return c.auth.Verify(strings.TrimRight(line, "\r\n"))
+}
+
+// WriteLegacy writes a message of the legacy protocol, which is not
+// terminated by a newline.
+func (c *Conn) WriteLegacy(message string) error {
+	_, err := c.Write([]byte(c.auth.Sign(message)))
+	return err
+}
+
+// Send writes a message.
+func (c *Conn) Send(message Message) error {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Write([]byte(c.auth.Sign(string(encoded)) + "\n"))
+	return err
+}
+
+// Receive reads a message. Lines of the legacy protocol are converted with
+// LegacyMessage.
+func (c *Conn) Receive() (Message, error) {
+	line, err := c.ReadLine()
+	if err != nil {
+		return Message{}, err
+	}
+
+	message, ok := ParseMessage(line)
+	if !ok {
+		return LegacyMessage(line), nil
+	}
+
+	if message.Version > ProtocolVersion {
+		return message, ErrUnsupportedVersion
+	}
+
+	return message, nil
+}
+
+// Request sends a message and waits for its reply. An error reply is
+// returned as a *RemoteError.
+func (c *Conn) Request(message Message) (Message, error) {
+	if err := c.Send(message); err != nil {
+		return Message{}, err
+	}
+
+	return c.ReceiveReply(message)
+}
+
+// ReceiveReply waits for the reply to a message which has been sent. An
+// error reply is returned as a *RemoteError.
+func (c *Conn) ReceiveReply(message Message) (Message, error) {
+	reply, err := c.Receive()
+	if err != nil {
+		return Message{}, err
+	}
+
+	if reply.ReplyTo != message.ID {
+		return reply, ErrUnexpectedReply
+	}
+
+	if reply.Type == TypeError {
+		return reply, &RemoteError{Message: reply.Error}
+	}
+
+	if reply.Type != TypeAck {
+		return reply, ErrUnexpectedReply
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,261 @@
+package control
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMessageData(t *testing.T) {
+	exitCode := 1
+	sent := StateData{
+		State:    "stopped",
+		ExitCode: &exitCode,
+	}
+
+	message, err := NewMessage(TypeState, sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Version != ProtocolVersion || message.Type != TypeState ||
+		message.ID == "" {
+		t.Fatalf("got message %+v", message)
+	}
+
+	var received StateData
+	if err := message.Decode(&received); err != nil {
+		t.Fatal(err)
+	}
+
+	if received.State != sent.State || received.ExitCode == nil ||
+		*received.ExitCode != exitCode {
+		t.Errorf("got %+v, want %+v", received, sent)
+	}
+
+	empty, err := NewMessage(TypeStop, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := empty.Decode(&received); err == nil {
+		t.Error("decoding a message without data succeeded")
+	}
+}
+
+func TestReplies(t *testing.T) {
+	request, _ := NewMessage(TypeStop, nil)
+
+	ack, err := request.Ack(CommandResultData{Method: "rcon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ack.Type != TypeAck || ack.ReplyTo != request.ID {
+		t.Errorf("got ack %+v", ack)
+	}
+
+	reject := request.Reject("no")
+	if reject.Type != TypeError || reject.ReplyTo != request.ID ||
+		reject.Error != "no" {
+		t.Errorf("got rejection %+v", reject)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		line        string
+		ok          bool
+		messageType string
+		version     int
+	}{
+		{`{"version": 1, "type": "stop", "id": "a"}`, true, TypeStop, 1},
+		{`{"type": "stop"}`, true, TypeStop, 0},
+		{`{"version": 2, "type": "new"}`, true, "new", 2},
+		{`{"version": 1}`, false, "", 0},
+		{`{"version": 1, "type": `, false, "", 0},
+		{`{not json}`, false, "", 0},
+		{"started", false, "", 0},
+		{"", false, "", 0},
+	}
+
+	for _, test := range tests {
+		message, ok := ParseMessage(test.line)
+		if ok != test.ok {
+			t.Errorf("ParseMessage(%q) got ok %v, want %v", test.line, ok,
+				test.ok)
+			continue
+		}
+
+		if message.Type != test.messageType ||
+			message.Version != test.version {
+			t.Errorf("ParseMessage(%q) got type %q version %d, want %q "+
+				"version %d", test.line, message.Type, message.Version,
+				test.messageType, test.version)
+		}
+	}
+}
+
+func TestLegacyMessage(t *testing.T) {
+	tests := []struct {
+		line        string
+		messageType string
+		state       string
+	}{
+		{"started", TypeState, "started"},
+		{"stopped", TypeState, "stopped"},
+		{"stop", TypeStop, ""},
+		{"shutdown", TypeShutdown, ""},
+		{"unknown", "unknown", ""},
+	}
+
+	for _, test := range tests {
+		message := LegacyMessage(test.line)
+		if message.Version != 0 || message.Type != test.messageType {
+			t.Errorf("LegacyMessage(%q) got %+v, want type %q", test.line,
+				message, test.messageType)
+			continue
+		}
+
+		if test.state == "" {
+			if len(message.Data) != 0 {
+				t.Errorf("LegacyMessage(%q) has data %s", test.line,
+					message.Data)
+			}
+			continue
+		}
+
+		var data StateData
+		if err := message.Decode(&data); err != nil ||
+			data.State != test.state {
+			t.Errorf("LegacyMessage(%q) got state %q, %v, want %q",
+				test.line, data.State, err, test.state)
+		}
+	}
+}
+
+// pipe returns both ends of a connection, signed with the same secret.
+func pipe(t *testing.T, secret string) (*Conn, *Conn) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return NewConn(a, NewAuthenticator(secret)),
+		NewConn(b, NewAuthenticator(secret))
+}
+
+func TestConnReceive(t *testing.T) {
+	for _, secret := range []string{"", "secret"} {
+		client, server := pipe(t, secret)
+
+		message, _ := NewMessage(TypeCommand, CommandData{Command: "list"})
+		go client.Send(message)
+
+		received, err := server.Receive()
+		if err != nil {
+			t.Fatalf("with secret %q: %v", secret, err)
+		}
+
+		if received.ID != message.ID || received.Type != TypeCommand {
+			t.Errorf("with secret %q: got %+v, want %+v", secret, received,
+				message)
+		}
+
+		// Legacy peers write bare strings and close the connection
+		// without ending the line.
+		go func() {
+			client.WriteLegacy("stopped")
+			client.Close()
+		}()
+
+		received, err = server.Receive()
+		if err != nil {
+			t.Fatalf("with secret %q: legacy: %v", secret, err)
+		}
+
+		if received.Version != 0 || received.Type != TypeState {
+			t.Errorf("with secret %q: got legacy %+v", secret, received)
+		}
+	}
+}
+
+func TestConnReceiveUnsupportedVersion(t *testing.T) {
+	client, server := pipe(t, "secret")
+
+	message, _ := NewMessage(TypeStop, nil)
+	message.Version = ProtocolVersion + 1
+	go client.Send(message)
+
+	received, err := server.Receive()
+	if err != ErrUnsupportedVersion {
+		t.Fatalf("got error %v, want %v", err, ErrUnsupportedVersion)
+	}
+
+	// The message is still returned so that it can be rejected.
+	if received.ID != message.ID {
+		t.Errorf("got %+v, want %+v", received, message)
+	}
+}
+
+func TestConnRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply func(request Message) Message
+		check func(err error) bool
+	}{
+		{
+			name: "ack",
+			reply: func(request Message) Message {
+				ack, _ := request.Ack(nil)
+				return ack
+			},
+			check: func(err error) bool { return err == nil },
+		},
+		{
+			name: "rejected",
+			reply: func(request Message) Message {
+				return request.Reject("no")
+			},
+			check: func(err error) bool {
+				remoteErr, ok := err.(*RemoteError)
+				return ok && remoteErr.Message == "no"
+			},
+		},
+		{
+			name: "reply to another message",
+			reply: func(request Message) Message {
+				ack, _ := Message{ID: "other"}.Ack(nil)
+				return ack
+			},
+			check: func(err error) bool { return err == ErrUnexpectedReply },
+		},
+		{
+			name: "not a reply",
+			reply: func(request Message) Message {
+				state, _ := NewMessage(TypeState, nil)
+				state.ReplyTo = request.ID
+				return state
+			},
+			check: func(err error) bool { return err == ErrUnexpectedReply },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := pipe(t, "secret")
+
+			go func() {
+				request, err := server.Receive()
+				if err == nil {
+					server.Send(test.reply(request))
+				}
+			}()
+
+			request, _ := NewMessage(TypeStop, nil)
+			if _, err := client.Request(request); !test.check(err) {
+				t.Errorf("got unexpected error %v", err)
+			}
+		})
+	}
+}
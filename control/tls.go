@@ -0,0 +1,170 @@
+package control
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"time"
+)
+
+const certificateValidity = time.Hour * 24 * 365 * 10
+
+var (
+	ErrNoCertificate = errors.New("control: peer presented no certificate")
+	ErrPinMismatch   = errors.New("control: peer certificate does not " +
+		"match the pinned certificate")
+	ErrInvalidPEM  = errors.New("control: invalid PEM data")
+	ErrUnknownPeer = errors.New("control: peer certificate is for an " +
+		"unknown name")
+)
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeCertificate(der []byte, key *ecdsa.PrivateKey) (certPEM []byte,
+	keyPEM []byte, err error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY",
+		Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// GenerateCA generates a self signed certificate authority, and returns its
+// certificate and private key in PEM form.
+func GenerateCA(commonName string) (certPEM []byte, keyPEM []byte,
+	err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certificateValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encodeCertificate(der, key)
+}
+
+// IssueCertificate issues a certificate for name signed by the given
+// certificate authority, usable for both ends of a connection. It returns
+// the certificate and private key in PEM form.
+func IssueCertificate(caCertPEM []byte, caKeyPEM []byte,
+	name string) (certPEM []byte, keyPEM []byte, err error) {
+	ca, err := tls.X509KeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert,
+		&key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encodeCertificate(der, key)
+}
+
+// CertificatePool returns a certificate pool containing the PEM encoded
+// certificates.
+func CertificatePool(certPEM []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		return nil, ErrInvalidPEM
+	}
+
+	return pool, nil
+}
+
+// PeerName returns the common name of the verified certificate presented by
+// the peer of a TLS connection that has completed its handshake.
+func PeerName(conn *tls.Conn) (string, error) {
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return "", ErrNoCertificate
+	}
+
+	return state.PeerCertificates[0].Subject.CommonName, nil
+}
+
+// PinnedVerifier returns a function for tls.Config.VerifyPeerCertificate
+// which only accepts a peer presenting exactly the PEM encoded certificate.
+func PinnedVerifier(pinnedPEM []byte) (func([][]byte,
+	[][]*x509.Certificate) error, error) {
+	block, _ := pem.Decode(pinnedPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, ErrInvalidPEM
+	}
+
+	pinned := sha256.Sum256(block.Bytes)
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrNoCertificate
+		}
+
+		presented := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(presented[:], pinned[:]) {
+			return ErrPinMismatch
+		}
+
+		return nil
+	}, nil
+}
@@ -0,0 +1,263 @@
+package control
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority with a certificate for the reverse proxy
+// and one for a backend named "test", as the reverse proxy generates them.
+type testCA struct {
+	cert     []byte
+	key      []byte
+	proxy    tls.Certificate
+	proxyPEM []byte
+	backend  tls.Certificate
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{}
+
+	var err error
+	ca.cert, ca.key, err = GenerateCA("test CA")
+	if err != nil {
+		t.Fatal("failed to generate CA:", err)
+	}
+
+	ca.proxy, ca.proxyPEM = issue(t, ca, "dynamicserver proxy")
+	ca.backend, _ = issue(t, ca, "test")
+	return ca
+}
+
+// issue issues a certificate for the name signed by the certificate
+// authority, and returns it along with its PEM form.
+func issue(t *testing.T, ca *testCA, name string) (tls.Certificate, []byte) {
+	certPEM, keyPEM, err := IssueCertificate(ca.cert, ca.key, name)
+	if err != nil {
+		t.Fatal("failed to issue certificate:", err)
+	}
+
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal("failed to load certificate:", err)
+	}
+
+	return certificate, certPEM
+}
+
+// backendConfig returns the TLS configuration of a backend presenting the
+// certificate and pinning the reverse proxy's certificate, for both ends
+// of a connection.
+func backendConfig(t *testing.T, certificate tls.Certificate,
+	pinnedPEM []byte) *tls.Config {
+	verifier, err := PinnedVerifier(pinnedPEM)
+	if err != nil {
+		t.Fatal("failed to create verifier:", err)
+	}
+
+	return &tls.Config{
+		Certificates:          []tls.Certificate{certificate},
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifier,
+	}
+}
+
+// proxyClientConfig returns the TLS configuration of a reverse proxy
+// connecting to the backend with the name.
+func proxyClientConfig(t *testing.T, ca *testCA, certificate tls.Certificate,
+	name string) *tls.Config {
+	pool, err := CertificatePool(ca.cert)
+	if err != nil {
+		t.Fatal("failed to create pool:", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      pool,
+		ServerName:   name,
+	}
+}
+
+// proxyServerConfig returns the TLS configuration of a reverse proxy
+// accepting connections from backends.
+func proxyServerConfig(t *testing.T, ca *testCA) *tls.Config {
+	pool, err := CertificatePool(ca.cert)
+	if err != nil {
+		t.Fatal("failed to create pool:", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{ca.proxy},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+}
+
+// handshake performs a TLS handshake between a client and a server with the
+// configurations over a local connection, and returns the errors of both
+// ends and the server's connection.
+func handshake(t *testing.T, client *tls.Config,
+	server *tls.Config) (error, error, *tls.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	defer listener.Close()
+
+	clientErr := make(chan error, 1)
+	go func() {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+		clientErr <- err
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal("failed to accept:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	serverConn := tls.Server(conn, server)
+	serverErr := serverConn.Handshake()
+	if serverErr != nil {
+		// Don't leave the client waiting on us.
+		conn.Close()
+	}
+
+	return <-clientErr, serverErr, serverConn
+}
+
+func TestProxyToBackend(t *testing.T) {
+	ca := newTestCA(t)
+
+	clientErr, serverErr, _ := handshake(t,
+		proxyClientConfig(t, ca, ca.proxy, "test"),
+		backendConfig(t, ca.backend, ca.proxyPEM))
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("expected handshake to succeed, but got %v and %v",
+			clientErr, serverErr)
+	}
+}
+
+func TestBackendToProxy(t *testing.T) {
+	ca := newTestCA(t)
+
+	clientErr, serverErr, conn := handshake(t,
+		backendConfig(t, ca.backend, ca.proxyPEM), proxyServerConfig(t, ca))
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("expected handshake to succeed, but got %v and %v",
+			clientErr, serverErr)
+	}
+
+	name, err := PeerName(conn)
+	if err != nil || name != "test" {
+		t.Errorf("got peer name %q and error %v, want %q", name, err, "test")
+	}
+}
+
+func TestBackendRejectsUnpinnedProxy(t *testing.T) {
+	ca := newTestCA(t)
+	other, _ := issue(t, ca, "dynamicserver proxy")
+	otherCA := newTestCA(t)
+
+	tests := []struct {
+		name  string
+		proxy tls.Certificate
+		err   error
+	}{
+		// Even a certificate from the same authority with the same name is
+		// rejected if it isn't the pinned one.
+		{"other certificate", other, ErrPinMismatch},
+		{"other authority", otherCA.proxy, ErrPinMismatch},
+		{"no certificate", tls.Certificate{}, nil},
+	}
+
+	for _, test := range tests {
+		client := proxyClientConfig(t, ca, test.proxy, "test")
+		if test.proxy.Certificate == nil {
+			client.Certificates = nil
+		}
+
+		_, serverErr, _ := handshake(t, client,
+			backendConfig(t, ca.backend, ca.proxyPEM))
+		if serverErr == nil {
+			t.Errorf("%s: expected the backend to reject the proxy",
+				test.name)
+		} else if test.err != nil && serverErr != test.err {
+			t.Errorf("%s: expected %v, but got %v", test.name, test.err,
+				serverErr)
+		}
+	}
+
+	// A backend connecting to a reverse proxy checks the pin too.
+	clientErr, _, _ := handshake(t, backendConfig(t, ca.backend, ca.proxyPEM),
+		proxyServerConfig(t, otherCA))
+	if clientErr != ErrPinMismatch {
+		t.Errorf("expected %v connecting to another proxy, but got %v",
+			ErrPinMismatch, clientErr)
+	}
+}
+
+func TestProxyRejectsWrongServerName(t *testing.T) {
+	ca := newTestCA(t)
+
+	clientErr, _, _ := handshake(t,
+		proxyClientConfig(t, ca, ca.proxy, "other"),
+		backendConfig(t, ca.backend, ca.proxyPEM))
+	if clientErr == nil {
+		t.Error("expected the proxy to reject a certificate for another " +
+			"backend")
+	}
+}
+
+func TestProxyRejectsOtherAuthority(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	// A backend with a certificate from another authority, which pins
+	// the right proxy.
+	_, serverErr, _ := handshake(t,
+		backendConfig(t, otherCA.backend, ca.proxyPEM),
+		proxyServerConfig(t, ca))
+	if serverErr == nil {
+		t.Error("expected the proxy to reject a backend certificate from " +
+			"another authority")
+	}
+
+	// And a backend connected to by the proxy.
+	clientErr, _, _ := handshake(t,
+		proxyClientConfig(t, ca, ca.proxy, "test"),
+		backendConfig(t, otherCA.backend, ca.proxyPEM))
+	if clientErr == nil {
+		t.Error("expected the proxy to reject a backend certificate from " +
+			"another authority")
+	}
+}
+
+func TestInvalidPEM(t *testing.T) {
+	ca := newTestCA(t)
+
+	for _, data := range [][]byte{nil, []byte("not PEM"), ca.key} {
+		if _, err := PinnedVerifier(data); err != ErrInvalidPEM {
+			t.Errorf("PinnedVerifier(%q) got %v, want %v", data, err,
+				ErrInvalidPEM)
+		}
+
+		if _, err := CertificatePool(data); err != ErrInvalidPEM {
+			t.Errorf("CertificatePool(%q) got %v, want %v", data, err,
+				ErrInvalidPEM)
+		}
+	}
+
+	verifier, _ := PinnedVerifier(ca.proxyPEM)
+	if err := verifier(nil, nil); err != ErrNoCertificate {
+		t.Errorf("got %v with no certificate, want %v", err,
+			ErrNoCertificate)
+	}
+}
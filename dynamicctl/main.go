@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// dynamicctl drives a running reverse proxy through its admin API.
+
+const usage = `Usage: dynamicctl [options] <command>
+
+Commands:
+  status                       List servers and their state
+  start <name>                 Start a server from its latest snapshot
+  stop <name>                  Shut a server down
+  snapshots <name>             List a server's snapshots
+  restore <name> <snapshot>    Start a server from the given snapshot ID
+  maintenance <name> on|off    Put a server in or out of maintenance
+  logs [-f] <name>             Show a server's recent log, -f to follow it
+  webhooks                     List recent webhook deliveries
+
+Options:
+`
+
+type serverStatus struct {
+	Name               string    `json:"name"`
+	State              string    `json:"state"`
+	Maintenance        bool      `json:"maintenance"`
+	DropletId          int       `json:"droplet_id"`
+	IPAddress          string    `json:"ip_address"`
+	NumConnections     int       `json:"num_connections"`
+	OnlinePlayers      int       `json:"online_players"`
+	LastConnectionTime time.Time `json:"last_connection_time"`
+	Operation          string    `json:"operation"`
+	StartupPhase       string    `json:"startup_phase"`
+}
+
+type snapshotStatus struct {
+	ID   int       `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+type logEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Server  string    `json:"server"`
+	Module  string    `json:"module"`
+	Message string    `json:"message"`
+}
+
+type webhookDelivery struct {
+	Time      time.Time `json:"time"`
+	URL       string    `json:"url"`
+	Event     string    `json:"event"`
+	Server    string    `json:"server"`
+	Attempts  int       `json:"attempts"`
+	Delivered bool      `json:"delivered"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type client struct {
+	address string
+	token   string
+	http    *http.Client
+}
+
+var jsonOutput bool
+
+func main() {
+	address := flag.String("address", envOr("DYNAMICCTL_ADDRESS",
+		"http://127.0.0.1:9020"), "admin API address, or $DYNAMICCTL_ADDRESS")
+	token := flag.String("token", os.Getenv("DYNAMICCTL_TOKEN"),
+		"admin API token, or $DYNAMICCTL_TOKEN")
+	flag.BoolVar(&jsonOutput, "json", false, "output JSON instead of tables")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &client{
+		address: strings.TrimSuffix(*address, "/"),
+		token:   *token,
+		http:    &http.Client{Timeout: time.Second * 30},
+	}
+
+	if err := run(c, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "dynamicctl:", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+var errUsage = errors.New("invalid arguments, see dynamicctl -h")
+
+func run(c *client, command string, args []string) error {
+	switch command {
+	case "status", "webhooks":
+		if len(args) != 0 {
+			return errUsage
+		}
+
+		if command == "webhooks" {
+			return webhooks(c)
+		}
+
+		return status(c)
+	case "start", "stop", "snapshots":
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		switch command {
+		case "start":
+			return action(c, args[0], "start", nil)
+		case "stop":
+			return action(c, args[0], "shutdown", nil)
+		}
+
+		return snapshots(c, args[0])
+	case "restore":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errors.New("snapshot must be a snapshot ID")
+		}
+
+		return action(c, args[0], "restore",
+			map[string]int{"snapshot_id": id})
+	case "maintenance":
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			return errUsage
+		}
+
+		return action(c, args[0], "maintenance",
+			map[string]bool{"enabled": args[1] == "on"})
+	case "logs":
+		follow := len(args) == 2 && args[0] == "-f"
+		if follow {
+			args = args[1:]
+		}
+
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		return logs(c, args[0], follow)
+	}
+
+	return errors.New("unknown command \"" + command + "\", see dynamicctl -h")
+}
+
+func (c *client) request(method string, path string,
+	body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.address+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		var apiErr apiError
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil &&
+			apiErr.Error != "" {
+			return nil, errors.New(apiErr.Error)
+		}
+
+		return nil, errors.New(resp.Status)
+	}
+
+	return resp, nil
+}
+
+// call makes a request, and decodes the response into result. The response
+// is printed as is when outputting JSON.
+func (c *client) call(method string, path string, body interface{},
+	result interface{}) error {
+	resp, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		var indented bytes.Buffer
+		if json.Indent(&indented, data, "", "\t") == nil {
+			data = append(indented.Bytes(), '\n')
+		}
+
+		os.Stdout.Write(data)
+	}
+
+	return json.Unmarshal(data, result)
+}
+
+func serverPath(name string) string {
+	return "/api/servers/" + url.PathEscape(name)
+}
+
+func status(c *client) error {
+	var servers []serverStatus
+	if err := c.call("GET", "/api/servers", nil, &servers); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tDROPLET\tIP\tCONNECTIONS\tPLAYERS\t"+
+		"LAST ACTIVITY\tOPERATION")
+
+	for _, server := range servers {
+		state := server.State
+		if server.StartupPhase != "" {
+			state += " (" + server.StartupPhase + ")"
+		}
+		if server.Maintenance {
+			state += " [maintenance]"
+		}
+
+		droplet := "-"
+		if server.DropletId != 0 {
+			droplet = strconv.Itoa(server.DropletId)
+		}
+
+		players := "-"
+		if server.OnlinePlayers >= 0 {
+			players = strconv.Itoa(server.OnlinePlayers)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", server.Name,
+			state, droplet, orDash(server.IPAddress), server.NumConnections,
+			players, formatTime(server.LastConnectionTime),
+			orDash(server.Operation))
+	}
+
+	return w.Flush()
+}
+
+func action(c *client, name string, action string,
+	body interface{}) error {
+	var server serverStatus
+	err := c.call("POST", serverPath(name)+"/"+action, body, &server)
+	if err != nil {
+		return err
+	}
+
+	if !jsonOutput {
+		fmt.Println(name+":", action, "requested, server is now",
+			server.State+".")
+	}
+
+	return nil
+}
+
+func snapshots(c *client, name string) error {
+	var snapshots []snapshotStatus
+	err := c.call("GET", serverPath(name)+"/snapshots", nil, &snapshots)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(w, "%d\t%s\n", snapshot.ID, formatTime(snapshot.Time))
+	}
+
+	return w.Flush()
+}
+
+func logs(c *client, name string, follow bool) error {
+	if !follow {
+		var entries []logEntry
+		err := c.call("GET", serverPath(name)+"/logs", nil, &entries)
+		if err != nil || jsonOutput {
+			return err
+		}
+
+		for _, entry := range entries {
+			printLogEntry(entry)
+		}
+
+		return nil
+	}
+
+	// Following streams the dashboard's events, which start with the recent
+	// log.
+	c.http.Timeout = 0
+	resp, err := c.request("GET", "/api/events", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1024*1024)
+
+	eventName := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			eventName = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && eventName == "log":
+			data := strings.TrimPrefix(line, "data: ")
+
+			var entry logEntry
+			if err := json.Unmarshal([]byte(data), &entry); err != nil ||
+				entry.Server != name {
+				continue
+			}
+
+			if jsonOutput {
+				fmt.Println(data)
+			} else {
+				printLogEntry(entry)
+			}
+		case line == "":
+			eventName = ""
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return errors.New("event stream closed")
+}
+
+func webhooks(c *client) error {
+	var deliveries []webhookDelivery
+	err := c.call("GET", "/api/webhooks", nil, &deliveries)
+	if err != nil || jsonOutput {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSERVER\tEVENT\tURL\tATTEMPTS\tRESULT")
+	for _, delivery := range deliveries {
+		result := "delivered"
+		if !delivery.Delivered {
+			result = "failed: " + delivery.Error
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			formatTime(delivery.Time), delivery.Server, delivery.Event,
+			delivery.URL, delivery.Attempts, result)
+	}
+
+	return w.Flush()
+}
+
+func printLogEntry(entry logEntry) {
+	fmt.Println(entry.Time.Local().Format("2006/01/02 15:04:05"),
+		strings.ToUpper(entry.Level), entry.Module, "|", entry.Message)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
@@ -0,0 +1,197 @@
+// Package logging implements the leveled, structured logs shared by the
+// reverse proxy and the backend. Entries are written as text or as one JSON
+// object per line.
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// Log levels, from least to most severe.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	errUnknownLevel  = errors.New("logging: unknown level")
+	errUnknownFormat = errors.New("logging: unknown format")
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+
+	return "unknown"
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// ParseLevel parses a level name such as "info". An empty name is the info
+// level.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+
+	return LevelInfo, errUnknownLevel
+}
+
+// Config is the logging section of a configuration file.
+type Config struct {
+	// Level is the least severe level logged, "info" by default.
+	Level string `json:"level"`
+	// Format is "text" (the default) or "json".
+	Format string `json:"format"`
+	// Directory is where log files are written. Log files are disabled if
+	// it is empty.
+	Directory string `json:"directory"`
+	// MaxSizeMB is the size at which log files are rotated.
+	MaxSizeMB int `json:"max_size_mb"`
+	// MaxFiles is how many rotated log files are kept.
+	MaxFiles int `json:"max_files"`
+}
+
+// Validate returns an error if the level or format are unknown.
+func (c Config) Validate() error {
+	if _, err := ParseLevel(c.Level); err != nil {
+		return err
+	}
+
+	if c.Format != "" && c.Format != FormatText && c.Format != FormatJSON {
+		return errUnknownFormat
+	}
+
+	return nil
+}
+
+// Entry is a single log entry.
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Level   Level     `json:"level"`
+	Server  string    `json:"server,omitempty"`
+	Module  string    `json:"module,omitempty"`
+	State   string    `json:"state,omitempty"`
+	Message string    `json:"msg"`
+}
+
+// Logger writes log entries at or above its level.
+type Logger struct {
+	lock   *sync.Mutex
+	level  Level
+	format string
+	output io.Writer
+}
+
+// New returns a logger writing text at the info level to standard error.
+func New() *Logger {
+	return &Logger{
+		lock:   &sync.Mutex{},
+		level:  LevelInfo,
+		format: FormatText,
+		output: os.Stderr,
+	}
+}
+
+// Configure sets the level and format of the logger.
+func (l *Logger) Configure(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	level, _ := ParseLevel(config.Level)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.level = level
+	l.format = config.Format
+	if l.format == "" {
+		l.format = FormatText
+	}
+
+	return nil
+}
+
+// Enabled returns whether entries at the level are written.
+func (l *Logger) Enabled(level Level) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return level >= l.level
+}
+
+// Write writes the entry to the logger's output, and to file if it isn't
+// nil.
+func (l *Logger) Write(entry Entry, file io.Writer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if entry.Level < l.level {
+		return
+	}
+
+	var line []byte
+	if l.format == FormatJSON {
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		line = []byte(entry.String())
+	}
+
+	l.output.Write(line)
+	if file != nil {
+		file.Write(line)
+	}
+}
+
+// String formats the entry as a line of text, such as:
+//
+//	2016/01/02 15:04:05 INFO vanilla | state | Changed state to Starting
+func (entry Entry) String() string {
+	line := entry.Time.Format("2006/01/02 15:04:05") + " " +
+		strings.ToUpper(entry.Level.String())
+
+	if entry.Server != "" {
+		line += " " + entry.Server + " |"
+	}
+
+	if entry.Module != "" {
+		line += " " + entry.Module + " |"
+	}
+
+	return line + " " + entry.Message + "\n"
+}
@@ -0,0 +1,144 @@
+package logging
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultMaxBytes = 10 * 1024 * 1024
+	defaultMaxFiles = 5
+)
+
+// RotatingWriter writes to a file, rotating it once it grows beyond
+// maxBytes. Rotated files are suffixed with .1 (the most recent) to
+// .maxFiles.
+type RotatingWriter struct {
+	lock     *sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// NewRotatingWriter returns a writer to the file at path. The file is
+// opened on the first write. maxBytes and maxFiles default to 10MB and 5
+// files if they are 0.
+func NewRotatingWriter(path string, maxBytes int64,
+	maxFiles int) *RotatingWriter {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBytes
+	}
+
+	if maxFiles <= 0 {
+		maxFiles = defaultMaxFiles
+	}
+
+	return &RotatingWriter{
+		lock:     &sync.Mutex{},
+		path:     path,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+	}
+}
+
+// File returns a rotating writer to name.log in the log directory, which is
+// relative to baseDir. It returns nil if log files are disabled.
+func (c Config) File(baseDir string, name string) *RotatingWriter {
+	if c.Directory == "" {
+		return nil
+	}
+
+	dir := c.Directory
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(baseDir, dir)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println("Failed to create log directory:", err)
+	}
+
+	return NewRotatingWriter(filepath.Join(dir, name+".log"),
+		int64(c.MaxSizeMB)*1024*1024, c.MaxFiles)
+}
+
+func (w *RotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *RotatingWriter) rotate() error {
+	w.file.Close()
+	w.file = nil
+
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		os.Rename(w.path+"."+strconv.Itoa(i),
+			w.path+"."+strconv.Itoa(i+1))
+	}
+
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+// Write never fails, as a failing write would stop a process' output from
+// being drained, which would eventually block the process. Errors are
+// written to the standard logger instead.
+func (w *RotatingWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file != nil && w.size+int64(len(data)) > w.maxBytes && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			log.Println("Failed to rotate log file:", err)
+		}
+	}
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			log.Println("Failed to open log file:", err)
+			return len(data), nil
+		}
+	}
+
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	if err != nil {
+		log.Println("Failed to write to log file:", err)
+	}
+
+	return len(data), nil
+}
+
+// Close closes the file. It is reopened on the next write.
+func (w *RotatingWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
@@ -1,70 +1,138 @@
 package main
 
 import (
-	"github.com/digitalocean/godo"
+	"github.com/1lann/dynamicserver/control"
 	"strconv"
 	"time"
 )
 
 var failureWait = time.Second * 5
 
+// actionCooldown is how long a lifecycle action keeps holding the state lock
+// after it returns, to give the provider time to reflect the change.
+var actionCooldown = time.Second * 10
+
 func (s *Server) Shutdown() {
+	if !s.requireLeader("shutdown") {
+		return
+	}
+
+	s.StateLock.Lock()
+	defer func() {
+		time.Sleep(actionCooldown)
+		s.StateLock.Unlock()
+	}()
+
 	s.ShutdownDeadline = time.Now().Add(time.Minute * 5)
 	s.Log("shutdown", "Shutting down server...")
-	s.SetState(stateShutdown)
+	s.beginOperation(operationShutdown)
+	if !s.SetState(stateShutdown) {
+		s.Warn("shutdown", "Not shutting down from state", s.State)
+		s.endOperation()
+		return
+	}
+
 	s.StopMinecraftServer()
-	s.SetState(stateShutdown)
-	s.TellRemote("shutdown")
+	if !s.SetState(stateShutdown) {
+		s.Warn("shutdown", "Server changed state to", s.State,
+			"while stopping Minecraft, not shutting down.")
+		s.endOperation()
+		return
+	}
+
+	var result control.CommandResultData
+	if s.TellRemote(control.TypeShutdown).Decode(&result) == nil {
+		s.logCommandResult("shutdown", result)
+	}
 	s.ShutdownDeadline = time.Now().Add(time.Minute)
+	writeJournal()
 	s.Log("shutdown", "Waiting for power off.")
 }
 
 func (s *Server) ForceShutdown() {
+	if !s.requireLeader("force shutdown") {
+		return
+	}
+
+	s.StateLock.Lock()
+	defer func() {
+		time.Sleep(actionCooldown)
+		s.StateLock.Unlock()
+	}()
+
+	s.forceShutdown()
+}
+
+// forceShutdown powers off the droplet. The state lock must be held.
+func (s *Server) forceShutdown() {
 	s.ShutdownDeadline = time.Now().Add(time.Minute * 10)
+	writeJournal()
 
-	s.Log("force shutdown", "WARNING: Force shutting down:", s.DropletId)
+	s.Warn("force shutdown", "Force shutting down:", s.DropletId)
 
 	for i := 0; i < 3; i++ {
-		_, _, err := doClient.DropletActions.PowerOff(s.DropletId)
+		err := s.Provider.PowerOff(s.DropletId)
 		if err != nil {
-			s.Log("force shutdown", "Error while force shutting down:", err)
+			s.Warn("force shutdown", "Error while force shutting down:", err)
 			continue
 		}
 
 		return
 	}
 
-	s.Log("force shutdown", "Giving up forced shutdown.")
+	s.Error("force shutdown", "Giving up forced shutdown.")
 }
 
 func (s *Server) Destroy() {
+	if !s.requireLeader("destroy") {
+		return
+	}
+
 	s.StateLock.Lock()
 	defer func() {
-		time.Sleep(time.Second * 10)
+		time.Sleep(actionCooldown)
 		s.StateLock.Unlock()
 	}()
 
+	if s.Operation == operationSnapshot {
+		// The snapshot has completed, as the droplet is destroyed once it
+		// has.
+		s.observeAction("snapshot", time.Now().Sub(s.OperationStarted))
+		s.notifyWebhooks(webhookSnapshotCompleted, "Snapshot completed.",
+			nil)
+	}
+
 	s.Log("destroy", "Destroying droplet:", s.DropletId)
+	s.beginOperation(operationDestroy)
 	s.SetState(stateDestroy)
 
 	if s.DropletId == 3608740 {
-		s.Log("destroy", "SAFETY CHECK FAIL: ATTEMPT TO DESTROY MAIN DROPLET.")
+		s.Error("destroy", "SAFETY CHECK FAIL: ATTEMPT TO DESTROY MAIN "+
+			"DROPLET.")
+		s.notifyWebhooks(webhookSafetyCheck, "Safety check failed: refused "+
+			"to destroy the main droplet.", map[string]interface{}{
+			"droplet_id": s.DropletId,
+		})
+		s.countActionFailure("destroy")
 		return
 	}
 
 	for i := 0; i < 3; i++ {
-		_, err := doClient.Droplets.Delete(s.DropletId)
+		err := s.Provider.DeleteMachine(s.DropletId)
 		if err != nil {
-			s.Log("destroy", "Error while destroying droplet:", err)
+			s.Warn("destroy", "Error while destroying droplet:", err)
 			time.Sleep(failureWait)
 			continue
 		}
 
 		s.Log("destroy", "Destroy successful.")
+		s.endOperation()
 		return
 	}
 
-	s.Log("destroy", "Giving up destroying.")
+	s.Error("destroy", "Giving up destroying.")
+	s.countActionFailure("destroy")
+	s.endOperation()
 	s.SetState(stateUnavailable)
 }
 
@@ -74,63 +142,84 @@ type snapshotInfo struct {
 }
 
 func (s *Server) Snapshot() {
+	if !s.requireLeader("snapshot") {
+		return
+	}
+
 	s.StateLock.Lock()
 	defer func() {
-		time.Sleep(time.Second * 10)
+		time.Sleep(actionCooldown)
 		s.StateLock.Unlock()
 	}()
 
+	s.beginOperation(operationSnapshot)
 	s.SetState(stateSnapshot)
 
 	// Will be followed by a destruction
+	requested := false
 	for i := 0; i < 3; i++ {
 		snapshotTime := time.Now().Unix()
-		_, _, err := doClient.DropletActions.Snapshot(s.DropletId,
+		err := s.Provider.Snapshot(s.DropletId,
 			s.Name+"-"+strconv.FormatInt(snapshotTime, 10))
 		if err != nil {
-			s.Log("snapshot", "Failed to snapshot droplet:", err)
+			s.Warn("snapshot", "Failed to snapshot droplet:", err)
 			time.Sleep(failureWait)
 			continue
 		}
 
 		s.Log("snapshot", "Creating snapshot with time:", snapshotTime)
+		requested = true
 		break
 	}
 
-	s.Log("snapshot", "Now deleting old snapshots.")
+	if !requested {
+		s.Error("snapshot", "Giving up snapshotting.")
+		s.countActionFailure("snapshot")
+	}
 
-	for i := 0; i < 3; i++ {
-		opt := &godo.ListOptions{
-			Page:    1,
-			PerPage: 100,
+	s.deleteOldSnapshots()
+}
+
+// listSnapshots returns the server's snapshots.
+func (s *Server) listSnapshots() ([]snapshotInfo, error) {
+	images, err := s.Provider.ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []snapshotInfo
+	prefixLength := len(s.Name) + 1
+
+	for _, image := range images {
+		if len(image.Name) > prefixLength &&
+			image.Name[:prefixLength] == s.Name+"-" {
+			value, err := strconv.ParseInt(image.Name[prefixLength:], 10, 64)
+			if err != nil {
+				s.Warn("snapshot", "Failed to parse snapshot name: "+
+					image.Name)
+				continue
+			}
+
+			snapshots = append(snapshots,
+				snapshotInfo{id: image.ID, time: value})
 		}
+	}
 
-		mcSnapshots := []snapshotInfo{}
+	return snapshots, nil
+}
+
+// deleteOldSnapshots deletes the oldest snapshots until only 2 remain.
+func (s *Server) deleteOldSnapshots() {
+	s.Log("snapshot", "Now deleting old snapshots.")
 
-		snapshots, _, err := doClient.Images.ListUser(opt)
+	for i := 0; i < 3; i++ {
+		mcSnapshots, err := s.listSnapshots()
 		if err != nil {
-			s.Log("snapshot", "Failed to list snapshots:", err)
+			s.Warn("snapshot", "Failed to list snapshots:", err)
 			time.Sleep(failureWait)
 			continue
 		}
 
-		for _, snapshot := range snapshots {
-			prefixLength := len(s.Name) + 1
-			if len(snapshot.Name) > prefixLength &&
-				snapshot.Name[:prefixLength] == s.Name+"-" {
-				value, err := strconv.ParseInt(snapshot.Name[prefixLength:],
-					10, 64)
-				if err != nil {
-					s.Log("snapshot", "Failed to parse snapshot name: "+
-						snapshot.Name)
-					continue
-				}
-
-				mcSnapshots = append(mcSnapshots,
-					snapshotInfo{id: snapshot.ID, time: value})
-			}
-		}
-
 		deletionAttempts := 0
 		for len(mcSnapshots) > 2 && deletionAttempts < 5 {
 			// Destroy until only 2 snapshots remain.
@@ -148,9 +237,9 @@ func (s *Server) Snapshot() {
 			if earliestIndex >= 0 {
 				s.Log("snapshot", "Removing snapshot with time:",
 					earliestSnapshot.time)
-				_, err := doClient.Images.Delete(earliestSnapshot.id)
+				err := s.Provider.DeleteImage(earliestSnapshot.id)
 				if err != nil {
-					s.Log("snapshot", "Failed to remove snapshot:", err)
+					s.Warn("snapshot", "Failed to remove snapshot:", err)
 					time.Sleep(failureWait)
 					continue
 				}
@@ -161,85 +250,86 @@ func (s *Server) Snapshot() {
 		}
 
 		if deletionAttempts >= 5 {
-			s.Log("snapshot", "Giving up deleting old snapshots.")
+			s.Error("snapshot", "Giving up deleting old snapshots.")
 		}
 
 		return
 	}
 
-	s.Log("snapshot", "Giving up finding old snapshots.")
+	s.Error("snapshot", "Giving up finding old snapshots.")
 }
 
 func (s *Server) Restore() {
+	s.RestoreSnapshot(0)
+}
+
+// RestoreSnapshot restores the server from the snapshot with the given ID, or
+// from the latest snapshot if the ID is 0.
+func (s *Server) RestoreSnapshot(snapshotID int) {
+	if !s.requireLeader("restore") {
+		return
+	}
+
 	s.StateLock.Lock()
 	defer func() {
-		time.Sleep(time.Second * 10)
+		time.Sleep(actionCooldown)
 		s.StateLock.Unlock()
 	}()
 
-	s.SetState(stateStarting)
+	s.beginOperation(operationRestore)
+	defer s.endOperation()
 
-	opt := &godo.ListOptions{
-		Page:    1,
-		PerPage: 100,
-	}
+	s.SetState(stateStarting)
+	s.beginBootTiming()
 
-	var latestSnapshot snapshotInfo
+	var chosenSnapshot snapshotInfo
 
 	for i := 0; i < 5; i++ {
-		snapshots, _, err := doClient.Images.ListUser(opt)
+		snapshots, err := s.listSnapshots()
 		if err != nil {
-			s.Log("restore", "Failed to list snapshots:", err)
+			s.Warn("restore", "Failed to list snapshots:", err)
 			time.Sleep(failureWait)
 			continue
 		}
-		for _, snapshot := range snapshots {
-			prefixLength := len(s.Name) + 1
-			if len(snapshot.Name) > prefixLength &&
-				snapshot.Name[:prefixLength] == s.Name+"-" {
-				value, err := strconv.ParseInt(snapshot.Name[prefixLength:],
-					10, 64)
-				if err != nil {
-					s.Log("restore", "Failed to parse snapshot name: "+
-						snapshot.Name)
-					continue
-				}
 
-				if value > latestSnapshot.time {
-					latestSnapshot = snapshotInfo{id: snapshot.ID, time: value}
+		for _, snapshot := range snapshots {
+			if snapshotID != 0 {
+				if snapshot.id == snapshotID {
+					chosenSnapshot = snapshot
 				}
+			} else if snapshot.time > chosenSnapshot.time {
+				chosenSnapshot = snapshot
 			}
 		}
 
 		break
 	}
 
-	if latestSnapshot.id == 0 {
-		s.Log("restore", "No valid snapshots found!")
+	if chosenSnapshot.id == 0 {
+		if snapshotID != 0 {
+			s.Error("restore", "Snapshot", snapshotID, "not found!")
+		} else {
+			s.Error("restore", "No valid snapshots found!")
+		}
+		s.countActionFailure("restore")
 		return
 	}
 
-	createRequest := &godo.DropletCreateRequest{
-		Name:   s.Name + "-automated",
-		Region: s.Droplet.Region,
-		Size:   s.Droplet.Memory,
-		Image: godo.DropletCreateImage{
-			ID: latestSnapshot.id,
-		},
-		SSHKeys: []godo.DropletCreateSSHKey{
-			godo.DropletCreateSSHKey{
-				Fingerprint: s.Droplet.SSHFingerprint,
-			},
-		},
+	createRequest := CreateRequest{
+		Name:           s.Name + "-automated",
+		Region:         s.Droplet.Region,
+		Size:           s.Droplet.Memory,
+		SSHFingerprint: s.Droplet.SSHFingerprint,
+		ImageID:        chosenSnapshot.id,
 	}
 
 	s.Log("restore", "Attempting to restore snapshot with time:",
-		latestSnapshot.time)
+		chosenSnapshot.time)
 
 	for i := 0; i < 3; i++ {
-		droplets, _, err := doClient.Droplets.List(opt)
+		droplets, err := s.Provider.ListMachines()
 		if err != nil {
-			s.Log("restore", "Failed to get droplet list:", err)
+			s.Warn("restore", "Failed to get droplet list:", err)
 			time.Sleep(failureWait)
 			continue
 		}
@@ -253,9 +343,10 @@ func (s *Server) Restore() {
 			}
 		}
 
-		_, _, err = doClient.Droplets.Create(createRequest)
+		s.setStartupPhase(phaseCreatingDroplet)
+		err = s.Provider.CreateMachine(createRequest)
 		if err != nil {
-			s.Log("restore", "Failed to create droplet:", err)
+			s.Warn("restore", "Failed to create droplet:", err)
 			time.Sleep(failureWait)
 			continue
 		}
@@ -265,5 +356,161 @@ func (s *Server) Restore() {
 		return
 	}
 
-	s.Log("restore", "Giving up restoring.")
+	s.Error("restore", "Giving up restoring.")
+	s.countActionFailure("restore")
+}
+
+// liveSnapshotTimeout is how long a snapshot of a running droplet is waited
+// on before giving up.
+var liveSnapshotTimeout = time.Hour
+
+// SnapshotNow snapshots the droplet while it keeps running, after asking the
+// Minecraft server to save the world. Unlike Snapshot, the droplet is not
+// destroyed afterwards.
+func (s *Server) SnapshotNow() {
+	if !s.requireLeader("snapshot") {
+		return
+	}
+
+	if !s.requestLiveSnapshot() {
+		return
+	}
+
+	// The snapshot may take a long time, so it is waited on without holding
+	// the state lock. The droplet monitor leaves the server alone while the
+	// operation is a live snapshot.
+	if s.waitForSnapshot(s.OperationStarted) {
+		s.deleteOldSnapshots()
+	}
+
+	s.endLiveSnapshot()
+}
+
+// requestLiveSnapshot saves the world and requests a snapshot of the running
+// droplet while holding the state lock, and returns whether the snapshot was
+// requested.
+func (s *Server) requestLiveSnapshot() bool {
+	s.StateLock.Lock()
+	defer func() {
+		time.Sleep(actionCooldown)
+		s.StateLock.Unlock()
+	}()
+
+	s.beginOperation(operationLiveSnapshot)
+
+	if output, err := s.RunRemoteCommand("save-all flush"); err != nil {
+		s.Warn("snapshot", "Failed to save the world, snapshotting anyway:",
+			err)
+	} else {
+		s.Log("snapshot", "Saved the world:", output)
+	}
+
+	for i := 0; i < 3; i++ {
+		snapshotTime := time.Now().Unix()
+		err := s.Provider.Snapshot(s.DropletId,
+			s.Name+"-"+strconv.FormatInt(snapshotTime, 10))
+		if err != nil {
+			s.Warn("snapshot", "Failed to snapshot droplet:", err)
+			time.Sleep(failureWait)
+			continue
+		}
+
+		s.Log("snapshot", "Creating live snapshot with time:", snapshotTime)
+		return true
+	}
+
+	s.Error("snapshot", "Giving up snapshotting.")
+	s.countActionFailure("snapshot")
+	s.endOperation()
+	return false
+}
+
+// endLiveSnapshot ends the live snapshot operation, unless another
+// operation has taken over since.
+func (s *Server) endLiveSnapshot() {
+	s.StateLock.Lock()
+	defer s.StateLock.Unlock()
+
+	if s.Operation == operationLiveSnapshot {
+		s.endOperation()
+	}
+}
+
+// waitForSnapshot waits for the snapshot requested since the given time to
+// finish, and returns whether it completed.
+func (s *Server) waitForSnapshot(requested time.Time) bool {
+	// Allow for some clock skew between us and the provider.
+	since := requested.Add(-time.Minute)
+	deadline := time.Now().Add(liveSnapshotTimeout)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second * 10)
+
+		actions, err := s.Provider.ListActions(s.DropletId)
+		if err != nil {
+			s.Warn("snapshot", "Failed to list actions:", err)
+			continue
+		}
+
+		for _, action := range actions {
+			if action.Type != "snapshot" || action.StartedAt.Before(since) {
+				continue
+			}
+
+			switch action.Status {
+			case "completed":
+				s.Log("snapshot", "Live snapshot completed.")
+				s.observeAction("snapshot", time.Now().Sub(requested))
+				s.notifyWebhooks(webhookSnapshotCompleted,
+					"Live snapshot completed.", map[string]interface{}{
+						"live": true,
+					})
+				return true
+			case "errored":
+				s.Log("snapshot", "Live snapshot failed.")
+				s.countActionFailure("snapshot")
+				return false
+			}
+
+			break
+		}
+	}
+
+	s.Error("snapshot", "Giving up waiting for the live snapshot.")
+	s.countActionFailure("snapshot")
+	return false
+}
+
+// resumeLiveSnapshot waits for a live snapshot which was in progress when
+// the reverse proxy restarted.
+func (s *Server) resumeLiveSnapshot(since time.Time) {
+	if s.waitForSnapshot(since) {
+		s.deleteOldSnapshots()
+	}
+
+	s.endLiveSnapshot()
+}
+
+// ForceShutdownNow shuts the server down without stopping Minecraft first,
+// and then snapshots and destroys it like any other shutdown.
+func (s *Server) ForceShutdownNow() {
+	if !s.requireLeader("force shutdown") {
+		return
+	}
+
+	s.StateLock.Lock()
+	defer func() {
+		time.Sleep(actionCooldown)
+		s.StateLock.Unlock()
+	}()
+
+	s.Log("force shutdown", "Force shutdown requested.")
+	s.beginOperation(operationShutdown)
+	if !s.SetState(stateShutdown) {
+		s.Warn("force shutdown", "Not shutting down from state", s.State)
+		s.endOperation()
+		return
+	}
+
+	s.forceShutdown()
 }
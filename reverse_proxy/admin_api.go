@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/1lann/dynamicserver/control"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The admin API is an HTTP/JSON API for looking at and controlling servers.
+// Every request must carry the configured token as a bearer token, or the
+// cookie set by opening the dashboard at /?token=<token>:
+//
+//	GET  /api/servers
+//	GET  /api/servers/<name>
+//	GET  /api/servers/<name>/snapshots
+//	GET  /api/servers/<name>/logs
+//	POST /api/servers/<name>/start
+//	POST /api/servers/<name>/shutdown
+//	POST /api/servers/<name>/force-shutdown
+//	POST /api/servers/<name>/snapshot
+//	POST /api/servers/<name>/restore       {"snapshot_id": 1234}
+//	POST /api/servers/<name>/maintenance   {"enabled": true}
+//	GET  /api/events                       (see dashboard.go)
+//	GET  /metrics                          (see metrics.go)
+//
+// Actions take minutes, so they are started in the background and the API
+// replies with 202 Accepted straight away.
+
+type serverStatus struct {
+	Name               string                 `json:"name"`
+	State              state                  `json:"state"`
+	Available          bool                   `json:"available"`
+	Maintenance        bool                   `json:"maintenance"`
+	DropletId          int                    `json:"droplet_id"`
+	IPAddress          string                 `json:"ip_address"`
+	NumConnections     int                    `json:"num_connections"`
+	OnlinePlayers      int                    `json:"online_players"`
+	LastConnectionTime time.Time              `json:"last_connection_time"`
+	Operation          string                 `json:"operation"`
+	OperationStarted   time.Time              `json:"operation_started"`
+	StartupPhase       string                 `json:"startup_phase,omitempty"`
+	Heartbeat          *control.HeartbeatData `json:"heartbeat,omitempty"`
+	LastHeartbeat      time.Time              `json:"last_heartbeat"`
+	Transitions        []stateTransition      `json:"transitions,omitempty"`
+}
+
+type snapshotStatus struct {
+	ID   int       `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) status() serverStatus {
+	status := serverStatus{
+		Name:               s.Name,
+		State:              s.State,
+		Available:          s.Available,
+		Maintenance:        s.Maintenance,
+		DropletId:          s.DropletId,
+		IPAddress:          s.IPAddress,
+		NumConnections:     s.NumConnections,
+		OnlinePlayers:      s.onlinePlayers(),
+		LastConnectionTime: s.LastConnectionTime,
+		Operation:          s.Operation,
+		OperationStarted:   s.OperationStarted,
+		LastHeartbeat:      s.LastHeartbeat,
+	}
+
+	if s.State == stateStarting {
+		status.StartupPhase = s.startupPhase()
+	}
+
+	if !s.LastHeartbeat.IsZero() {
+		heartbeat := s.Heartbeat
+		status.Heartbeat = &heartbeat
+	}
+
+	return status
+}
+
+func startAdminAPI(config Config) {
+	if config.AdminAPI.Listen == "" {
+		return
+	}
+
+	if config.AdminAPI.Token == "" {
+		Warn("admin api", "Not starting the admin API, as no token is set.")
+		return
+	}
+
+	token := []byte(config.AdminAPI.Token)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/servers", handleListServers)
+	mux.HandleFunc("/api/servers/", handleServerRequest)
+	mux.HandleFunc("/api/events", handleEvents)
+	mux.HandleFunc("/api/webhooks", handleWebhookDeliveries)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/", handleDashboard)
+
+	Log("admin api", "Listening on "+config.AdminAPI.Listen+".")
+	err := http.ListenAndServe(config.AdminAPI.Listen,
+		requireToken(token, mux))
+	if err != nil {
+		Warn("admin api", "Failed to listen:", err)
+	}
+}
+
+const tokenCookie = "dynamicserver_token"
+
+// requireToken rejects requests which don't carry the token. A token given
+// in the query string is moved into a cookie, so that browsers can sign in.
+func requireToken(token []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if given := r.URL.Query().Get("token"); given != "" &&
+			subtle.ConstantTimeCompare([]byte(given), token) == 1 {
+			http.SetCookie(w, &http.Cookie{
+				Name:     tokenCookie,
+				Value:    given,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if cookie, err := r.Cookie(tokenCookie); err == nil && given == "" {
+			given = cookie.Value
+		}
+
+		if subtle.ConstantTimeCompare([]byte(given), token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, apiError{Error: message})
+}
+
+func findServer(name string) *Server {
+	for _, server := range allServers {
+		if server.Name == name {
+			return server
+		}
+	}
+
+	return nil
+}
+
+func handleListServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	statuses := []serverStatus{}
+	for _, server := range allServers {
+		statuses = append(statuses, server.status())
+	}
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func handleServerRequest(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/servers/"),
+		"/")
+	if len(parts) > 2 {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	server := findServer(parts[0])
+	if server == nil {
+		writeAPIError(w, http.StatusNotFound, "unknown server")
+		return
+	}
+
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	switch action {
+	case "", "snapshots", "logs":
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed,
+				"method not allowed")
+			return
+		}
+	default:
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed,
+				"method not allowed")
+			return
+		}
+	}
+
+	switch action {
+	case "":
+		status := server.status()
+		status.Transitions = server.TransitionHistory()
+		writeJSON(w, http.StatusOK, status)
+	case "snapshots":
+		handleListSnapshots(w, server)
+	case "logs":
+		entries := []logEntry{}
+		for _, entry := range getRecentLogs() {
+			if entry.Server == server.Name {
+				entries = append(entries, entry)
+			}
+		}
+
+		writeJSON(w, http.StatusOK, entries)
+	case "start", "shutdown", "force-shutdown", "snapshot", "restore":
+		handleServerAction(w, r, server, action)
+	case "maintenance":
+		var request struct {
+			Enabled bool `json:"enabled"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		server.SetMaintenance(request.Enabled)
+		writeJSON(w, http.StatusOK, server.status())
+	default:
+		writeAPIError(w, http.StatusNotFound, "unknown action")
+	}
+}
+
+func handleListSnapshots(w http.ResponseWriter, server *Server) {
+	snapshots, err := server.listSnapshots()
+	if err != nil {
+		server.Warn("admin api", "Failed to list snapshots:", err)
+		writeAPIError(w, http.StatusBadGateway, "failed to list snapshots")
+		return
+	}
+
+	statuses := []snapshotStatus{}
+	for _, snapshot := range snapshots {
+		statuses = append(statuses, snapshotStatus{
+			ID:   snapshot.id,
+			Time: time.Unix(snapshot.time, 0),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// handleServerAction starts a lifecycle action if the server is in a state
+// that allows it.
+func handleServerAction(w http.ResponseWriter, r *http.Request,
+	server *Server, action string) {
+	if !isLeader() {
+		writeAPIError(w, http.StatusServiceUnavailable,
+			"this reverse proxy is on standby")
+		return
+	}
+
+	if !server.Available {
+		writeAPIError(w, http.StatusConflict, "server is not available")
+		return
+	}
+
+	if server.Operation != operationNone {
+		writeAPIError(w, http.StatusConflict, "server is busy with "+
+			server.Operation)
+		return
+	}
+
+	var run func()
+
+	switch action {
+	case "start":
+		if server.State != stateOff {
+			writeAPIError(w, http.StatusConflict, "server is not off")
+			return
+		}
+
+		run = server.Restore
+	case "restore":
+		var request struct {
+			SnapshotID int `json:"snapshot_id"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil ||
+			request.SnapshotID == 0 {
+			writeAPIError(w, http.StatusBadRequest,
+				"snapshot_id is required")
+			return
+		}
+
+		if server.State != stateOff {
+			writeAPIError(w, http.StatusConflict, "server is not off")
+			return
+		}
+
+		run = func() { server.RestoreSnapshot(request.SnapshotID) }
+	case "shutdown", "force-shutdown":
+		if !server.dropletRunning() {
+			writeAPIError(w, http.StatusConflict, "server is not running")
+			return
+		}
+
+		run = server.Shutdown
+		if action == "force-shutdown" {
+			run = server.ForceShutdownNow
+		}
+	case "snapshot":
+		if !server.dropletRunning() {
+			writeAPIError(w, http.StatusConflict, "server is not running")
+			return
+		}
+
+		run = server.SnapshotNow
+	}
+
+	server.Log("admin api", "Running "+action+" requested through the "+
+		"admin API.")
+	if action == "start" || action == "restore" {
+		// Starts through the admin API aren't limited, but count towards
+		// the server's starts.
+		server.recordStart()
+		server.notifyWebhooks(webhookStartRequested, "Started through the "+
+			"admin API.", map[string]interface{}{"started_by": "admin api"})
+	}
+	go run()
+
+	writeJSON(w, http.StatusAccepted, server.status())
+}
+
+// dropletRunning returns whether the server has a droplet which isn't being
+// shut down.
+func (s *Server) dropletRunning() bool {
+	switch s.State {
+	case stateStarting, stateStarted, stateUnavailable, stateCrashed:
+		return s.DropletId != 0
+	}
+
+	return false
+}
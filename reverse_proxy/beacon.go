@@ -37,13 +37,39 @@ func (s *Server) StartServerHandler(player *handler.Player) string {
 			"Sorry, you are not whitelisted to start the server!"
 	}
 
+	if !isLeader() {
+		s.Log("beacon", player.Username+" attempted to start the server "+
+			"on a standby reverse proxy.")
+		return chat.Format(s.Messages.MessagePrefix) +
+			"Sorry, the server can't be started right now.\n" +
+			"Try connecting again in a few seconds."
+	}
+
+	if reason := s.checkAndRecordStart(player.Username); reason != "" {
+		s.Log("beacon", player.Username+" attempted to start the server "+
+			"over its start limits.")
+		return chat.Format(s.Messages.MessagePrefix) + reason
+	}
+
 	s.Log("beacon", player.Username+" started the server.")
+	s.notifyWebhooks(webhookStartRequested, player.Username+
+		" started the server.", map[string]interface{}{
+		"started_by": player.Username,
+	})
 
 	go s.Restore()
 
+	// Recorded boot times take precedence over the configured boot time.
+	bootTime := chat.Format(s.Messages.BootTime)
+	if estimate, ok := s.bootEstimate(); ok {
+		bootTime = formatBootTime(estimate)
+	} else if bootTime == "" {
+		return chat.Format(s.Messages.MessagePrefix) +
+			"The server is now starting. Come back in a few minutes."
+	}
+
 	return chat.Format(s.Messages.MessagePrefix) +
-		"The server is now starting. Come back in about " +
-		chat.Format(s.Messages.BootTime) + "."
+		"The server is now starting. Come back in about " + bootTime + "."
 
 }
 
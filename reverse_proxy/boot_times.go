@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long each phase of a restore takes is recorded on disk, per server and
+// droplet size, and the median of the most recent boots is used to estimate
+// how long a starting server has left.
+
+const (
+	bootPhaseCreate    = "create_droplet"
+	bootPhaseBackend   = "backend_up"
+	bootPhaseMinecraft = "minecraft_ready"
+)
+
+var bootPhases = []string{bootPhaseCreate, bootPhaseBackend,
+	bootPhaseMinecraft}
+
+const maxBootSamples = 10
+
+type bootSample struct {
+	Time time.Time `json:"time"`
+	// Seconds is how long each phase took, in seconds. Phases which were
+	// skipped, such as when the reverse proxy restarted during a boot, are
+	// missing.
+	Seconds map[string]float64 `json:"seconds"`
+}
+
+// bootTimer times the boot in progress.
+type bootTimer struct {
+	started      time.Time
+	phase        int
+	phaseStarted time.Time
+	seconds      map[string]float64
+}
+
+var bootTimesLock = &sync.Mutex{}
+
+// bootTimesPath is empty if boot times aren't kept, such as in tests.
+var bootTimesPath string
+
+// bootTimes are the most recent boot samples, keyed by bootTimesKey.
+var bootTimes = make(map[string][]bootSample)
+
+func loadBootTimes(config Config) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		Fatal("boot times", "Could not resolve filepath:", err)
+	}
+
+	bootTimesPath = config.BootTimes
+	if bootTimesPath == "" {
+		bootTimesPath = "boot_times.json"
+	}
+
+	if !filepath.IsAbs(bootTimesPath) {
+		bootTimesPath = filepath.Join(dir, bootTimesPath)
+	}
+
+	data, err := ioutil.ReadFile(bootTimesPath)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		Warn("boot times", "Failed to read boot times, ignoring them:", err)
+		return
+	}
+
+	bootTimesLock.Lock()
+	defer bootTimesLock.Unlock()
+
+	if err := json.Unmarshal(data, &bootTimes); err != nil {
+		Warn("boot times", "Failed to decode boot times, ignoring them:", err)
+		bootTimes = make(map[string][]bootSample)
+	}
+}
+
+// writeBootTimes writes the boot times to disk. bootTimesLock must be held.
+func writeBootTimes() {
+	if bootTimesPath == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(bootTimes, "", "\t")
+	if err != nil {
+		Warn("boot times", "Failed to encode boot times:", err)
+		return
+	}
+
+	err = ioutil.WriteFile(bootTimesPath+".tmp", data, 0600)
+	if err != nil {
+		Warn("boot times", "Failed to write boot times:", err)
+		return
+	}
+
+	err = os.Rename(bootTimesPath+".tmp", bootTimesPath)
+	if err != nil {
+		Warn("boot times", "Failed to replace boot times:", err)
+	}
+}
+
+func (s *Server) bootTimesKey() string {
+	return s.Name + "/" + s.Droplet.Memory
+}
+
+// beginBootTiming starts timing a restore.
+func (s *Server) beginBootTiming() {
+	s.boot = &bootTimer{
+		started:      time.Now(),
+		phaseStarted: time.Now(),
+		seconds:      make(map[string]float64),
+	}
+
+	if estimate, ok := s.bootEstimate(); ok {
+		s.Log("boot times", "Estimated boot time is",
+			estimate.String()+" ("+s.describeBootEstimates()+").")
+	} else {
+		s.Log("boot times", "No boot times recorded yet for size "+
+			s.Droplet.Memory+".")
+	}
+}
+
+// advanceBootPhase records that the boot has reached the given phase. Phases
+// only move forwards.
+func (s *Server) advanceBootPhase(phase string) {
+	if s.boot == nil {
+		return
+	}
+
+	index := bootPhaseIndex(phase)
+	if index <= s.boot.phase {
+		return
+	}
+
+	s.boot.seconds[bootPhases[s.boot.phase]] =
+		time.Now().Sub(s.boot.phaseStarted).Seconds()
+	s.boot.phase = index
+	s.boot.phaseStarted = time.Now()
+}
+
+// finishBootTiming records the boot in progress now that the server has
+// started.
+func (s *Server) finishBootTiming() {
+	if s.boot == nil {
+		return
+	}
+
+	boot := s.boot
+	s.boot = nil
+
+	boot.seconds[bootPhases[boot.phase]] =
+		time.Now().Sub(boot.phaseStarted).Seconds()
+
+	var phases []string
+	for _, phase := range bootPhases {
+		if seconds, found := boot.seconds[phase]; found {
+			phases = append(phases, phase+" "+formatSeconds(seconds))
+		}
+	}
+
+	s.Log("boot times", "Boot took", time.Now().Sub(boot.started).String()+
+		" ("+strings.Join(phases, ", ")+").")
+	s.observeAction("restore", time.Now().Sub(boot.started))
+
+	bootTimesLock.Lock()
+	defer bootTimesLock.Unlock()
+
+	key := s.bootTimesKey()
+	samples := append(bootTimes[key], bootSample{
+		Time:    time.Now(),
+		Seconds: boot.seconds,
+	})
+	if len(samples) > maxBootSamples {
+		samples = samples[len(samples)-maxBootSamples:]
+	}
+
+	bootTimes[key] = samples
+	writeBootTimes()
+}
+
+func bootTimingHook(s *Server, from state, to state) {
+	switch to {
+	case stateStarted:
+		s.finishBootTiming()
+	case stateCrashed:
+		// The backend gave up restarting the Minecraft server.
+		if s.boot != nil {
+			s.countActionFailure("restore")
+		}
+
+		s.boot = nil
+	case stateUnavailable:
+		// Boots which are interrupted say nothing about how long a boot
+		// takes, but may still recover, so they aren't failures.
+		s.boot = nil
+	case stateOff, stateShutdown:
+		s.boot = nil
+	}
+}
+
+func bootPhaseIndex(phase string) int {
+	for i, bootPhase := range bootPhases {
+		if bootPhase == phase {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// phaseEstimate returns the median time the phase took in recent boots.
+func (s *Server) phaseEstimate(phase string) (time.Duration, bool) {
+	bootTimesLock.Lock()
+	defer bootTimesLock.Unlock()
+
+	var values []float64
+	for _, sample := range bootTimes[s.bootTimesKey()] {
+		if seconds, found := sample.Seconds[phase]; found {
+			values = append(values, seconds)
+		}
+	}
+
+	if len(values) == 0 {
+		return 0, false
+	}
+
+	sort.Float64s(values)
+	median := values[len(values)/2]
+	if len(values)%2 == 0 {
+		median = (values[len(values)/2-1] + median) / 2
+	}
+
+	return time.Duration(median * float64(time.Second)), true
+}
+
+// bootEstimate returns the estimated time a whole boot takes.
+func (s *Server) bootEstimate() (time.Duration, bool) {
+	var total time.Duration
+	for _, phase := range bootPhases {
+		estimate, ok := s.phaseEstimate(phase)
+		if !ok {
+			return 0, false
+		}
+
+		total += estimate
+	}
+
+	return total, true
+}
+
+// bootTimeLeft returns the estimated time left until the server has
+// started, if it is being restored.
+func (s *Server) bootTimeLeft() (time.Duration, bool) {
+	boot := s.boot
+	if boot == nil {
+		return 0, false
+	}
+
+	var left time.Duration
+	for i, phase := range bootPhases[boot.phase:] {
+		estimate, ok := s.phaseEstimate(phase)
+		if !ok {
+			return 0, false
+		}
+
+		if i == 0 {
+			estimate -= time.Now().Sub(boot.phaseStarted)
+			if estimate < 0 {
+				estimate = 0
+			}
+		}
+
+		left += estimate
+	}
+
+	return left, true
+}
+
+func (s *Server) describeBootEstimates() string {
+	var phases []string
+	for _, phase := range bootPhases {
+		if estimate, ok := s.phaseEstimate(phase); ok {
+			phases = append(phases, phase+" "+
+				formatSeconds(estimate.Seconds()))
+		}
+	}
+
+	return strings.Join(phases, ", ")
+}
+
+func formatSeconds(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+// formatBootTime formats an estimated time for players, such as "3 minutes"
+// or "40 seconds".
+func formatBootTime(d time.Duration) string {
+	if d < time.Minute {
+		seconds := int((d+time.Second*5)/(time.Second*10)) * 10
+		if seconds < 10 {
+			seconds = 10
+		}
+
+		return strconv.Itoa(seconds) + " seconds"
+	}
+
+	minutes := int((d + time.Second*30) / time.Minute)
+	if minutes == 1 {
+		return "1 minute"
+	}
+
+	return strconv.Itoa(minutes) + " minutes"
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/1lann/dynamicserver/control"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The reverse proxy acts as a small certificate authority for the control
+// channel. It issues a certificate for itself and for each backend, named
+// after the server. Backends pin the reverse proxy's certificate.
+
+const (
+	caCertFile    = "ca.pem"
+	caKeyFile     = "ca-key.pem"
+	proxyCertFile = "proxy.pem"
+	proxyKeyFile  = "proxy-key.pem"
+	proxyCertName = "dynamicserver reverse proxy"
+)
+
+// tlsRecordHandshake is the first byte of a TLS connection.
+const tlsRecordHandshake = 0x16
+
+var controlCertificate tls.Certificate
+var controlCAPool *x509.CertPool
+
+func certificateDirectory(config Config) string {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		Fatal("certificates", "Could not resolve filepath:", err)
+	}
+
+	certDir := config.CertificateDirectory
+	if certDir == "" {
+		certDir = "certs"
+	}
+
+	if !filepath.IsAbs(certDir) {
+		certDir = filepath.Join(dir, certDir)
+	}
+
+	return certDir
+}
+
+// loadCertificateAuthority loads the certificate authority and the reverse
+// proxy's own certificate, generating them if they don't exist yet.
+func loadCertificateAuthority(config Config) error {
+	certDir := certificateDirectory(config)
+	if err := os.MkdirAll(certDir, 0700); err != nil {
+		return err
+	}
+
+	caCertPath := filepath.Join(certDir, caCertFile)
+	caKeyPath := filepath.Join(certDir, caKeyFile)
+
+	if _, err := os.Stat(caCertPath); os.IsNotExist(err) {
+		Log("certificates", "Generating a new control channel certificate "+
+			"authority in", certDir)
+
+		certPEM, keyPEM, err := control.GenerateCA(
+			"dynamicserver control channel CA")
+		if err != nil {
+			return err
+		}
+
+		if err := writeKeyPair(caCertPath, certPEM, caKeyPath,
+			keyPEM); err != nil {
+			return err
+		}
+	}
+
+	caCertPEM, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return err
+	}
+
+	caKeyPEM, err := ioutil.ReadFile(caKeyPath)
+	if err != nil {
+		return err
+	}
+
+	controlCAPool, err = control.CertificatePool(caCertPEM)
+	if err != nil {
+		return err
+	}
+
+	proxyCertPath := filepath.Join(certDir, proxyCertFile)
+	proxyKeyPath := filepath.Join(certDir, proxyKeyFile)
+
+	if _, err := os.Stat(proxyCertPath); os.IsNotExist(err) {
+		certPEM, keyPEM, err := control.IssueCertificate(caCertPEM, caKeyPEM,
+			proxyCertName)
+		if err != nil {
+			return err
+		}
+
+		if err := writeKeyPair(proxyCertPath, certPEM, proxyKeyPath,
+			keyPEM); err != nil {
+			return err
+		}
+	}
+
+	controlCertificate, err = tls.LoadX509KeyPair(proxyCertPath,
+		proxyKeyPath)
+	return err
+}
+
+func writeKeyPair(certPath string, certPEM []byte, keyPath string,
+	keyPEM []byte) error {
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certPath, certPEM, 0644)
+}
+
+// issueCertCommand implements `reverse_proxy issue-cert <name>`, which issues
+// a certificate for a backend and writes the files the backend needs to a
+// directory named after it.
+func issueCertCommand(name string) {
+	config := loadConfig()
+
+	found := false
+	for _, server := range config.Servers {
+		if server.Name == name {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		Fatal("certificates", "There is no server named \""+name+
+			"\" in the configuration.")
+	}
+
+	if err := loadCertificateAuthority(config); err != nil {
+		Fatal("certificates", "Failed to load certificate authority:", err)
+	}
+
+	certDir := certificateDirectory(config)
+
+	caCertPEM, err := ioutil.ReadFile(filepath.Join(certDir, caCertFile))
+	if err != nil {
+		Fatal("certificates", "Failed to read certificate authority:", err)
+	}
+
+	caKeyPEM, err := ioutil.ReadFile(filepath.Join(certDir, caKeyFile))
+	if err != nil {
+		Fatal("certificates", "Failed to read certificate authority:", err)
+	}
+
+	proxyCertPEM, err := ioutil.ReadFile(filepath.Join(certDir,
+		proxyCertFile))
+	if err != nil {
+		Fatal("certificates", "Failed to read proxy certificate:", err)
+	}
+
+	certPEM, keyPEM, err := control.IssueCertificate(caCertPEM, caKeyPEM,
+		name)
+	if err != nil {
+		Fatal("certificates", "Failed to issue certificate:", err)
+	}
+
+	outputDir := filepath.Join(certDir, name)
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		Fatal("certificates", "Failed to create output directory:", err)
+	}
+
+	err = writeKeyPair(filepath.Join(outputDir, "certificate.pem"), certPEM,
+		filepath.Join(outputDir, "key.pem"), keyPEM)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(outputDir, "proxy.pem"),
+			proxyCertPEM, 0644)
+	}
+	if err != nil {
+		Fatal("certificates", "Failed to write certificate:", err)
+	}
+
+	Log("certificates", "Issued a certificate for "+name+" in "+outputDir+
+		". Copy certificate.pem, key.pem and proxy.pem to the backend, "+
+		"and set \"control_tls\": true for the server.")
+}
+
+// dialRemote connects to the backend's control port, over TLS if the server
+// has it enabled.
+func (s *Server) dialRemote(timeout time.Duration) (net.Conn, error) {
+	address := net.JoinHostPort(s.IPAddress, globalConfig.CommunicationsPort)
+
+	if !s.ControlTLS {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+		Certificates: []tls.Certificate{controlCertificate},
+		RootCAs:      controlCAPool,
+		ServerName:   s.Name,
+	})
+}
+
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(data []byte) (int, error) {
+	return c.reader.Read(data)
+}
+
+// acceptRemote detects whether an incoming control connection uses TLS, and
+// if so completes the handshake, requiring a certificate issued by us. It
+// returns the connection to use, and the certificate's name if TLS is used.
+func acceptRemote(conn net.Conn) (net.Conn, string, error) {
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	firstByte, err := reader.Peek(1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn = &peekedConn{Conn: conn, reader: reader}
+
+	if firstByte[0] != tlsRecordHandshake {
+		return conn, "", nil
+	}
+
+	if controlCAPool == nil {
+		return nil, "", control.ErrUnknownPeer
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{controlCertificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    controlCAPool,
+	})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, "", err
+	}
+
+	name, err := control.PeerName(tlsConn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return tlsConn, name, nil
+}
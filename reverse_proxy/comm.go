@@ -1,33 +1,54 @@
 package main
 
 import (
-	"bufio"
-	"io/ioutil"
+	"github.com/1lann/dynamicserver/control"
 	"net"
-	"strings"
 	"time"
 )
 
-func (s *Server) IsMinecraftServerRunning() bool {
-	conn, err := net.Dial("tcp",
-		s.IPAddress+":"+globalConfig.CommunicationsPort)
+// connectRemote connects to the backend and reads its greeting, which
+// carries its state. Legacy backends greet with their bare state instead.
+func (s *Server) connectRemote() (*control.Conn, control.Message, error) {
+	conn, err := s.dialRemote(time.Second * 5)
 	if err != nil {
-		s.Log("communications", "Failed to connect to remote:", err)
-		return false
+		return nil, control.Message{}, err
 	}
 
-	defer conn.Close()
-	reader := bufio.NewReader(conn)
+	remote := control.NewConn(conn, s.auth)
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	hello, err := remote.Receive()
+	if err != nil {
+		remote.Close()
+		return nil, control.Message{}, err
+	}
 
-	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if hello.Type != control.TypeHello &&
+		!(hello.Version == 0 && hello.Type == control.TypeState) {
+		remote.Close()
+		return nil, control.Message{}, control.ErrUnexpectedReply
+	}
 
-	data, err := reader.ReadBytes('\n')
+	s.ProtocolVersion = hello.Version
+	return remote, hello, nil
+}
+
+func (s *Server) IsMinecraftServerRunning() bool {
+	remote, hello, err := s.connectRemote()
 	if err != nil {
-		s.Log("communications", "Failed to read response from remote:", err)
+		s.Warn("communications", "Failed to connect to remote:", err)
 		return false
 	}
 
-	if string(data[:len(data)-1]) == "started" {
+	defer remote.Close()
+
+	var data control.StateData
+	if err := hello.Decode(&data); err != nil {
+		s.Warn("communications", "Invalid greeting from remote:", err)
+		return false
+	}
+
+	if data.State == "started" {
 		return true
 	}
 
@@ -35,9 +56,10 @@ func (s *Server) IsMinecraftServerRunning() bool {
 }
 
 func (s *Server) StopMinecraftServer() {
-	s.TellRemote("stop")
-
+	// Start waiting before asking, as the backend may report that it stopped
+	// before acknowledging the request.
 	s.notifyChannel = make(chan interface{})
+	s.notifyStopped = true
 
 	go func() {
 		time.Sleep(time.Second * 30)
@@ -48,29 +70,180 @@ func (s *Server) StopMinecraftServer() {
 		}
 	}()
 
-	s.notifyStopped = true
+	reply := s.TellRemote(control.TypeStop)
+
+	var result control.CommandResultData
+	if reply.Decode(&result) == nil {
+		s.logCommandResult("stop", result)
+
+		if result.Saved {
+			s.Log("communications", "Backend confirmed the world saved.")
+		} else {
+			s.Warn("communications", "Backend stopped the server "+
+				"with \""+result.Method+"\" and could not confirm the "+
+				"world saved.")
+		}
+	}
+
 	<-s.notifyChannel
 }
 
-func (s *Server) TellRemote(message string) {
+// notifyMinecraftStopped wakes up a pending StopMinecraftServer, and returns
+// whether there was one waiting.
+func (s *Server) notifyMinecraftStopped() bool {
+	if !s.notifyStopped {
+		return false
+	}
+
+	s.notifyStopped = false
+	close(s.notifyChannel)
+	return true
+}
+
+// logCommandResult logs the result of a command the backend ran, if it
+// failed.
+func (s *Server) logCommandResult(name string,
+	result control.CommandResultData) {
+	if result.ExitCode == nil || *result.ExitCode == 0 {
+		return
+	}
+
+	s.Warn("communications", "Backend's "+name+" command exited "+
+		"with code", *result.ExitCode, "and output:", result.Output)
+}
+
+// TellRemote sends a request to the backend, and waits for it to be
+// acknowledged. Legacy backends do not acknowledge requests, in which case
+// the returned reply is empty.
+func (s *Server) TellRemote(messageType string) control.Message {
+	reply, err := s.RequestRemote(messageType, nil)
+	if err != nil {
+		s.Warn("communications", "Failed to send "+messageType+
+			" request:", err)
+	}
+
+	return reply
+}
+
+// remoteStopTimeout is how long the backend may take to stop the Minecraft
+// server or shut down, if it doesn't say how long it may take. It is longer
+// than older backends allow by default for saving and stopping over RCON, and
+// then running the stop command.
+const remoteStopTimeout = time.Minute * 3
+
+// remoteTimeoutMargin is how much longer than the backend allows itself to
+// wait for its reply.
+const remoteTimeoutMargin = time.Second * 30
+
+// remoteTimeout returns how long to wait for the reply to a request, given
+// the backend's greeting.
+func remoteTimeout(messageType string, hello control.Message) time.Duration {
+	var data control.StateData
+	hello.Decode(&data)
+
+	var seconds int
+	switch messageType {
+	case control.TypeStop:
+		seconds = data.StopTimeoutSeconds
+	case control.TypeShutdown:
+		seconds = data.ShutdownTimeoutSeconds
+	default:
+		// Commands such as saving the world may take a while.
+		return time.Minute
+	}
+
+	if seconds <= 0 {
+		return remoteStopTimeout
+	}
+
+	return time.Duration(seconds)*time.Second + remoteTimeoutMargin
+}
+
+// RequestRemote sends a request with data to the backend, and returns its
+// reply. Connecting and sending the request are retried, but once the request
+// has been sent it is never sent again, as the backend may have acted on it.
+func (s *Server) RequestRemote(messageType string,
+	data interface{}) (control.Message, error) {
+	var reply control.Message
+	var err error
+
 	for i := 0; i < 3; i++ {
-		conn, err := net.DialTimeout("tcp",
-			s.IPAddress+":"+globalConfig.CommunicationsPort, time.Second*5)
-		if err != nil {
-			s.Log("communications", "Failed to connect to remote:", err)
-			continue
+		var sent bool
+		reply, sent, err = s.requestRemoteOnce(messageType, data)
+		if err == nil || sent {
+			return reply, err
 		}
+	}
 
-		defer conn.Close()
+	return reply, err
+}
 
-		_, err = conn.Write([]byte(message))
-		if err != nil {
-			s.Log("communications", "Failed to send stop message:", err)
-			continue
+// requestRemoteOnce makes a single attempt at a request, and returns whether
+// the request was sent.
+func (s *Server) requestRemoteOnce(messageType string,
+	data interface{}) (control.Message, bool, error) {
+	remote, hello, err := s.connectRemote()
+	if err != nil {
+		return control.Message{}, false, err
+	}
+
+	defer remote.Close()
+
+	if hello.Version == 0 {
+		if data != nil {
+			return control.Message{}, false, control.ErrUnsupportedVersion
 		}
 
-		break
+		err := remote.WriteLegacy(messageType)
+		return control.Message{}, err == nil, err
+	}
+
+	request, err := control.NewMessage(messageType, data)
+	if err != nil {
+		return control.Message{}, false, err
 	}
+
+	remote.SetDeadline(time.Now().Add(remoteTimeout(messageType, hello)))
+	if err := remote.Send(request); err != nil {
+		return control.Message{}, false, err
+	}
+
+	reply, err := remote.ReceiveReply(request)
+	return reply, true, err
+}
+
+// RunRemoteCommand runs a Minecraft console command on the backend, and
+// returns its output.
+func (s *Server) RunRemoteCommand(command string) (string, error) {
+	reply, err := s.RequestRemote(control.TypeCommand,
+		control.CommandData{Command: command})
+	if err != nil {
+		return "", err
+	}
+
+	var result control.CommandResultData
+	if err := reply.Decode(&result); err != nil {
+		return "", err
+	}
+
+	return result.Output, nil
+}
+
+// receiveCrashReport keeps and logs the crash report sent along with a
+// restarting or crashed state.
+func (s *Server) receiveCrashReport(data control.StateData) {
+	if data.ExitCode != nil {
+		s.Log("communications", "Minecraft server exited with code",
+			*data.ExitCode)
+	}
+
+	if data.CrashReport == "" {
+		return
+	}
+
+	s.CrashReport = data.CrashReport
+	s.Log("communications", "Crash report "+data.CrashReportFile+":\n"+
+		data.CrashReport)
 }
 
 func startComm() {
@@ -94,7 +267,7 @@ func startComm() {
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	remoteAddr := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	remoteAddr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
 	// Check IP address
 	var server *Server
@@ -106,7 +279,7 @@ func handleConnection(conn net.Conn) {
 	}
 
 	if server == nil {
-		Log("communications", "Attempted connection from unknown IP:",
+		Warn("communications", "Attempted connection from unknown IP:",
 			remoteAddr)
 		return
 	}
@@ -115,38 +288,145 @@ func handleConnection(conn net.Conn) {
 		return
 	}
 
+	conn, peerName, err := acceptRemote(conn)
+	if err != nil {
+		server.Warn("communications", "Failed to accept connection from "+
+			remoteAddr+":", err)
+		return
+	}
+
+	if peerName == "" && server.ControlTLS {
+		server.Warn("communications", "Rejected connection from "+
+			remoteAddr+" without TLS.")
+		return
+	}
+
+	if peerName != "" && peerName != server.Name {
+		server.Warn("communications", "Rejected connection from "+
+			remoteAddr+" with a certificate for \""+peerName+"\".")
+		return
+	}
+
 	if server.State == stateDestroy || server.State == stateSnapshot {
 		// Ignore request, you're about to be crushed!
 		return
 	}
 
-	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	remote := control.NewConn(conn, server.auth)
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	request, err := remote.Receive()
+	if err == control.ErrUnsupportedVersion {
+		server.Warn("communications", "Remote uses unsupported protocol "+
+			"version:", request.Version)
+		remote.Send(request.Reject(err.Error()))
+		return
+	} else if err != nil {
+		server.Warn("communications", "Rejected request from "+remoteAddr+":",
+			err)
+		return
+	}
+
+	server.ProtocolVersion = request.Version
+	incrementCounter("dynamicserver_control_messages_total",
+		"server", server.Name, "type", request.Type)
+	if request.Type == control.TypeState {
+		server.Log("communications", "Received request:", request.Type)
+	}
+
+	var data control.StateData
+	var heartbeat control.HeartbeatData
+	var progress control.ProgressData
+
+	switch request.Type {
+	case control.TypeState:
+		err = request.Decode(&data)
+	case control.TypeHeartbeat:
+		err = request.Decode(&heartbeat)
+	case control.TypeProgress:
+		err = request.Decode(&progress)
+	default:
+		server.Warn("communications", "Unknown request:", request.Type)
+		if request.Version > 0 {
+			remote.Send(request.Reject("unknown message type"))
+		}
+		return
+	}
 
-	data, err := ioutil.ReadAll(conn)
 	if err != nil {
-		server.Log("communications",
-			"Error receiving request from remote:", err)
+		server.Warn("communications", "Invalid "+request.Type+" request:", err)
+		if request.Version > 0 {
+			remote.Send(request.Reject("invalid " + request.Type + " data"))
+		}
 		return
 	}
 
-	request := string(data)
-	server.Log("communications", "Received request:", request)
-	switch request {
+	if request.Version > 0 {
+		ack, err := request.Ack(nil)
+		if err == nil {
+			err = remote.Send(ack)
+		}
+
+		if err != nil {
+			server.Warn("communications", "Failed to acknowledge request:",
+				err)
+		}
+	}
+
+	switch request.Type {
+	case control.TypeHeartbeat:
+		server.receiveHeartbeat(heartbeat)
+		return
+	case control.TypeProgress:
+		server.receiveProgress(progress)
+		return
+	}
+
+	switch data.State {
 	case "started":
 		if server.IsMinecraftServerResponding() {
 			server.SetState(stateStarted)
 		} else {
 			server.SetState(stateStarting)
+			server.setStartupPhase(phaseStartingJava)
 		}
 	case "stopped":
-		if server.notifyStopped {
-			server.notifyStopped = false
-			close(server.notifyChannel)
+		if data.ExitCode != nil {
+			server.Log("communications", "Minecraft server exited with code",
+				*data.ExitCode)
+		}
+
+		if data.StartFailure != nil {
+			server.logCommandResult("start", *data.StartFailure)
+		}
+
+		if server.notifyMinecraftStopped() {
 			return
 		}
 
 		server.SetState(stateUnavailable)
+	case "restarting":
+		server.receiveCrashReport(data)
+		server.Log("communications", "Backend is restarting the crashed "+
+			"Minecraft server, restart", data.Restarts)
+		server.SetState(stateStarting)
+		server.setStartupPhase(phaseRestarting)
+	case "crashed":
+		server.receiveCrashReport(data)
+		if data.StartFailure != nil {
+			server.logCommandResult("start", *data.StartFailure)
+		}
+
+		if data.RetryingRestart {
+			server.Log("communications", "Backend failed to restart the "+
+				"Minecraft server, restart", data.Restarts,
+				"and will try again.")
+		} else {
+			server.Log("communications", "Backend gave up restarting the "+
+				"Minecraft server after", data.Restarts, "restarts.")
+		}
+		server.SetState(stateCrashed)
 	default:
-		server.Log("communications", "Unknown request:", request)
+		server.Log("communications", "Unknown state:", data.State)
 	}
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/1lann/dynamicserver/control"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// silentBackend greets the reverse proxy and reads its request, and then
+// hangs up without replying, as a backend which dies while handling a
+// request does. The first refuse connections are closed before greeting.
+type silentBackend struct {
+	lock     *sync.Mutex
+	refuse   int
+	requests []string
+}
+
+func (b *silentBackend) serve(listener net.Listener,
+	auth *control.Authenticator) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b.lock.Lock()
+		refuse := b.refuse > 0
+		b.refuse--
+		b.lock.Unlock()
+
+		if refuse {
+			conn.Close()
+			continue
+		}
+
+		remote := control.NewConn(conn, auth)
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+		hello, _ := control.NewMessage(control.TypeHello,
+			control.StateData{State: "started"})
+		remote.Send(hello)
+
+		request, err := remote.Receive()
+		if err == nil {
+			b.lock.Lock()
+			b.requests = append(b.requests, request.Type)
+			b.lock.Unlock()
+		}
+
+		conn.Close()
+	}
+}
+
+func TestRequestRemoteRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		refuse int
+		// requests is how many requests should reach the backend.
+		requests int
+	}{
+		{"sent once", 0, 1},
+		{"retried before sending", 2, 1},
+		{"gave up connecting", 3, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &Server{auth: control.NewAuthenticator("secret")}
+			server.Name = testServerName
+			server.IPAddress = "127.0.0.1"
+
+			backend := &silentBackend{lock: &sync.Mutex{},
+				refuse: test.refuse}
+			var listener net.Listener
+			listener, globalConfig.CommunicationsPort = listenLocal(t)
+			go backend.serve(listener, control.NewAuthenticator("secret"))
+
+			_, err := server.RequestRemote(control.TypeCommand,
+				control.CommandData{Command: "save-all"})
+			if err == nil {
+				t.Fatal("expected the request to fail")
+			}
+
+			backend.lock.Lock()
+			defer backend.lock.Unlock()
+			if len(backend.requests) != test.requests {
+				t.Errorf("expected %d requests to reach the backend, but "+
+					"got %d", test.requests, len(backend.requests))
+			}
+		})
+	}
+}
+
+func TestRemoteTimeout(t *testing.T) {
+	hello, _ := control.NewMessage(control.TypeHello, control.StateData{
+		State:                  "started",
+		StopTimeoutSeconds:     600,
+		ShutdownTimeoutSeconds: 70,
+	})
+	oldHello, _ := control.NewMessage(control.TypeHello,
+		control.StateData{State: "started"})
+	legacyHello := control.LegacyMessage("started")
+
+	tests := []struct {
+		messageType string
+		hello       control.Message
+		want        time.Duration
+	}{
+		{control.TypeStop, hello, time.Second*600 + remoteTimeoutMargin},
+		{control.TypeShutdown, hello, time.Second*70 + remoteTimeoutMargin},
+		{control.TypeCommand, hello, time.Minute},
+		{control.TypeStop, oldHello, remoteStopTimeout},
+		{control.TypeShutdown, oldHello, remoteStopTimeout},
+		{control.TypeStop, legacyHello, remoteStopTimeout},
+	}
+
+	for _, test := range tests {
+		got := remoteTimeout(test.messageType, test.hello)
+		if got != test.want {
+			t.Errorf("remoteTimeout(%q) with %s got %v, want %v",
+				test.messageType, test.hello.Data, got, test.want)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"github.com/1lann/beacon/handler"
+	"github.com/1lann/dynamicserver/control"
+	"github.com/1lann/dynamicserver/logging"
 	"gopkg.in/fsnotify.v1"
 	"io/ioutil"
 	"os"
@@ -11,13 +13,17 @@ import (
 )
 
 type ConfigServer struct {
-	Name                string   `json:"name"`
-	Available           bool     `json:"available"`
-	Hostnames           []string `json:"hostnames"`
-	MaxPlayers          int      `json:"max_players"`
-	ProtocolNumber      int      `json:"protocol_number"`
-	AutoShutdownMinutes int      `json:"auto_shutdown_minutes"`
-	Droplet             struct {
+	Name                    string   `json:"name"`
+	Available               bool     `json:"available"`
+	Hostnames               []string `json:"hostnames"`
+	MaxPlayers              int      `json:"max_players"`
+	ProtocolNumber          int      `json:"protocol_number"`
+	AutoShutdownMinutes     int      `json:"auto_shutdown_minutes"`
+	ProviderName            string   `json:"provider"`
+	ControlSecret           string   `json:"control_secret"`
+	ControlTLS              bool     `json:"control_tls"`
+	HeartbeatTimeoutSeconds int      `json:"heartbeat_timeout_seconds"`
+	Droplet                 struct {
 		Memory         string `json:"memory"`
 		Region         string `json:"region"`
 		SSHFingerprint string `json:"ssh_fingerprint"`
@@ -28,13 +34,29 @@ type ConfigServer struct {
 		ServerInfoPrefix string `json:"server_info_prefix"`
 		BootTime         string `json:"boot_time"`
 	} `json:"messages"`
-	Whitelist []string `json:"start_whitelist"`
+	Whitelist   []string        `json:"start_whitelist"`
+	StartLimits StartLimits     `json:"start_limits"`
+	Webhooks    []WebhookConfig `json:"webhooks"`
 }
 
 type Config struct {
-	APIToken           string         `json:"api_token"`
-	CommunicationsPort string         `json:"communications_port"`
-	Servers            []ConfigServer `json:"servers"`
+	APIToken             string `json:"api_token"`
+	CommunicationsPort   string `json:"communications_port"`
+	StateJournal         string `json:"state_journal"`
+	CertificateDirectory string `json:"certificate_directory"`
+	BootTimes            string `json:"boot_times"`
+	StartUsage           string `json:"start_usage"`
+	LeaderElection       struct {
+		Lock string `json:"lock"`
+		Path string `json:"path"`
+	} `json:"leader_election"`
+	Logging  logging.Config `json:"logging"`
+	AdminAPI struct {
+		Listen string `json:"listen"`
+		Token  string `json:"token"`
+	} `json:"admin_api"`
+	Webhooks []WebhookConfig `json:"webhooks"`
+	Servers  []ConfigServer  `json:"servers"`
 }
 
 func loadConfig() Config {
@@ -61,23 +83,26 @@ func liveLoadConfig() {
 	time.Sleep(time.Second * 3)
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
-		Log("config", "Could not resolve filepath:", err)
+		Warn("config", "Could not resolve filepath:", err)
 		return
 	}
 
 	data, err := ioutil.ReadFile(dir + "/config.json")
 	if err != nil {
-		Log("config", "Failed to read configuration:", err)
+		Warn("config", "Failed to read configuration:", err)
 		return
 	}
 
 	var newConfig Config
 	err = json.Unmarshal(data, &newConfig)
 	if err != nil {
-		Log("config", "Failed to decode configuration:", err)
+		Warn("config", "Failed to decode configuration:", err)
 		return
 	}
 
+	configureLogging(newConfig)
+	setGlobalWebhooks(newConfig.Webhooks)
+
 	if len(newConfig.Servers) != len(allServers) {
 		Log("config", "Number of servers have changed. "+
 			"You must restart the reverse proxy for changes to take place.")
@@ -89,6 +114,11 @@ func liveLoadConfig() {
 			"the server to use the new API key.")
 	}
 
+	if newConfig.Logging.Directory != globalConfig.Logging.Directory {
+		Log("config", "The log directory has changed. You must restart "+
+			"the server to use the new log directory.")
+	}
+
 	if newConfig.CommunicationsPort != globalConfig.CommunicationsPort {
 		Log("config", "The communications port has changed. You must restart "+
 			"the server to use the new communications port.")
@@ -103,30 +133,49 @@ func liveLoadConfig() {
 			continue
 		}
 
+		if currentServer.ProviderName != newServer.ProviderName {
+			currentServer.Log("config", "The provider has changed. You must "+
+				"restart the reverse proxy to use the new provider.")
+		}
+
+		if currentServer.ControlSecret != newServer.ControlSecret {
+			currentServer.ControlSecret = newServer.ControlSecret
+			currentServer.auth =
+				control.NewAuthenticator(newServer.ControlSecret)
+			currentServer.Log("config", "Control secret changed.")
+		}
+
+		if newServer.ControlTLS && controlCAPool == nil {
+			err := loadCertificateAuthority(globalConfig)
+			if err != nil {
+				currentServer.Warn("config", "Failed to load control channel "+
+					"certificates, not enabling TLS:", err)
+				newServer.ControlTLS = false
+			}
+		}
+
+		currentServer.ControlTLS = newServer.ControlTLS
 		currentServer.Messages = newServer.Messages
 		currentServer.Whitelist = newServer.Whitelist
+		currentServer.StartLimits = newServer.StartLimits
 		currentServer.Hostnames = newServer.Hostnames
 		currentServer.MaxPlayers = newServer.MaxPlayers
 		currentServer.ProtocolNumber = newServer.ProtocolNumber
 		currentServer.Droplet = newServer.Droplet
 		currentServer.AutoShutdownMinutes = newServer.AutoShutdownMinutes
+		currentServer.HeartbeatTimeoutSeconds =
+			newServer.HeartbeatTimeoutSeconds
+
+		webhooksLock.Lock()
+		currentServer.Webhooks = newServer.Webhooks
+		webhooksLock.Unlock()
 
 		currentServer.PingStatus.MaxPlayers = currentServer.MaxPlayers
 		currentServer.PingStatus.ProtocolNumber = currentServer.ProtocolNumber
 
-		if newServer.Available {
-			currentServer.Available = true
-			currentServer.setStateRaw(currentServer.State)
-
-			if currentServer.State != stateStarted &&
-				currentServer.State != stateOff {
-				handler.Handle(currentServer.Hostnames,
-					currentServer.ResponseHandler)
-			}
-		} else {
-			currentServer.Available = false
-			currentServer.SetState(stateUnavailable)
-		}
+		currentServer.configAvailable = newServer.Available
+		currentServer.setAvailable(newServer.Available &&
+			!currentServer.Maintenance)
 	}
 
 	Log("config", "Reloaded configuration.")
@@ -154,7 +203,7 @@ func watchConfig() {
 
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
-		Log("config watcher", "Could not resolve filepath:", err)
+		Warn("config watcher", "Could not resolve filepath:", err)
 		return
 	}
 
@@ -163,3 +212,33 @@ func watchConfig() {
 		Fatal("config watcher", err)
 	}
 }
+
+// setAvailable makes the server available or unavailable to players.
+func (s *Server) setAvailable(available bool) {
+	if available {
+		s.Available = true
+		s.setStateRaw(s.State)
+
+		if s.State != stateStarted && s.State != stateOff {
+			handler.Handle(s.Hostnames, s.ResponseHandler)
+		}
+	} else {
+		s.Available = false
+		s.SetState(stateUnavailable)
+	}
+}
+
+// SetMaintenance puts the server in or out of maintenance mode, in which it
+// is unavailable to players as if it was configured to be.
+func (s *Server) SetMaintenance(enabled bool) {
+	s.Maintenance = enabled
+	writeJournal()
+
+	if enabled {
+		s.Log("config", "Maintenance mode enabled.")
+	} else {
+		s.Log("config", "Maintenance mode disabled.")
+	}
+
+	s.setAvailable(s.configAvailable && !enabled)
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"strings"
+	"net"
+	"strconv"
 	"time"
 )
 
 func trackForwardConnect(ipAddress string) {
-	resolvedIP := strings.Split(ipAddress, ":")[0]
+	resolvedIP, _, _ := net.SplitHostPort(ipAddress)
 	for _, server := range allServers {
 		if server.IPAddress == resolvedIP {
 			server.NumConnections++
@@ -16,11 +17,12 @@ func trackForwardConnect(ipAddress string) {
 }
 
 func trackForwardDisconnect(ipAddress string, duration time.Duration) {
-	resolvedIP := strings.Split(ipAddress, ":")[0]
+	resolvedIP, _, _ := net.SplitHostPort(ipAddress)
 	for _, server := range allServers {
 		if server.IPAddress == resolvedIP {
 			if duration > time.Second*20 {
 				server.LastConnectionTime = time.Now()
+				writeJournal()
 			}
 			server.NumConnections--
 			break
@@ -31,7 +33,7 @@ func trackForwardDisconnect(ipAddress string, duration time.Duration) {
 func startConnectionMonitor() {
 	for {
 		for _, server := range allServers {
-			if server.Available {
+			if server.Available && isLeader() {
 				checkServerConnections(server)
 			}
 		}
@@ -44,10 +46,27 @@ func checkServerConnections(server *Server) {
 	server.StateLock.Lock()
 	defer server.StateLock.Unlock()
 
+	// Players may be connected without going through us, so also trust the
+	// backend's count if we have one.
+	if server.onlinePlayers() > 0 {
+		return
+	}
+
+	// Live snapshots no longer hold the state lock, so wait for them to
+	// finish before shutting down.
+	if server.Operation == operationLiveSnapshot {
+		return
+	}
+
 	if server.State == stateStarted && server.NumConnections == 0 &&
 		time.Now().Sub(server.LastConnectionTime) >=
 			time.Duration(server.AutoShutdownMinutes)*time.Minute {
 		server.Log("connection tracker", "Auto shutdown initiated.")
+		server.notifyWebhooks(webhookAutoShutdown, "Shutting down after "+
+			strconv.Itoa(server.AutoShutdownMinutes)+" minutes without "+
+			"players.", map[string]interface{}{
+			"idle_minutes": server.AutoShutdownMinutes,
+		})
 		go server.Shutdown()
 	}
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The dashboard is a web page served by the admin API which shows the state
+// of every server, their recent transitions and the log, and has buttons to
+// start, stop and put servers in maintenance. It is kept up to date with
+// Server-Sent Events from /api/events.
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+const maxDashboardTransitions = 10
+
+const dashboardRefreshInterval = time.Second * 2
+
+// dashboardKeepAlive is how often a comment is sent to idle event streams,
+// so that proxies in between don't close them.
+const dashboardKeepAlive = time.Second * 30
+
+type event struct {
+	name string
+	data interface{}
+}
+
+var subscribersLock = &sync.Mutex{}
+var subscribers = make(map[chan event]bool)
+
+// publishEvent sends an event to every open event stream. Streams which
+// can't keep up miss events.
+func publishEvent(name string, data interface{}) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+
+	for subscriber := range subscribers {
+		select {
+		case subscriber <- event{name: name, data: data}:
+		default:
+		}
+	}
+}
+
+func subscribeEvents() chan event {
+	subscriber := make(chan event, 64)
+
+	subscribersLock.Lock()
+	subscribers[subscriber] = true
+	subscribersLock.Unlock()
+
+	return subscriber
+}
+
+func unsubscribeEvents(subscriber chan event) {
+	subscribersLock.Lock()
+	delete(subscribers, subscriber)
+	subscribersLock.Unlock()
+}
+
+func dashboardStatuses() []serverStatus {
+	statuses := []serverStatus{}
+	for _, server := range allServers {
+		status := server.status()
+		status.Transitions = server.TransitionHistory()
+		if len(status.Transitions) > maxDashboardTransitions {
+			status.Transitions = status.Transitions[len(status.Transitions)-
+				maxDashboardTransitions:]
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+func dashboardTransitionHook(s *Server, from state, to state) {
+	publishEvent("servers", dashboardStatuses())
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError,
+			"streaming is not supported")
+		return
+	}
+
+	subscriber := subscribeEvents()
+	defer unsubscribeEvents(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for _, entry := range getRecentLogs() {
+		writeEvent(w, "log", entry)
+	}
+
+	lastStatuses := writeEvent(w, "servers", dashboardStatuses())
+	flusher.Flush()
+
+	// Connection counts and heartbeats change without a transition, so the
+	// servers are also sent whenever they have changed.
+	refresh := time.NewTicker(dashboardRefreshInterval)
+	defer refresh.Stop()
+	lastWrite := time.Now()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-subscriber:
+			data := writeEvent(w, e.name, e.data)
+			if e.name == "servers" {
+				lastStatuses = data
+			}
+		case <-refresh.C:
+			data, err := json.Marshal(dashboardStatuses())
+			if err == nil && !bytes.Equal(data, lastStatuses) {
+				lastStatuses = writeEvent(w, "servers", json.RawMessage(data))
+			} else if time.Now().Sub(lastWrite) < dashboardKeepAlive {
+				continue
+			} else {
+				w.Write([]byte(": keep-alive\n\n"))
+			}
+		}
+
+		lastWrite = time.Now()
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes an event to an event stream, and returns its data.
+func writeEvent(w http.ResponseWriter, name string,
+	value interface{}) []byte {
+	data, err := json.Marshal(value)
+	if err != nil {
+		Warn("dashboard", "Failed to encode event:", err)
+		return nil
+	}
+
+	w.Write([]byte("event: " + name + "\ndata: "))
+	w.Write(data)
+	w.Write([]byte("\n\n"))
+	return data
+}
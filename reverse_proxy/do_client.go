@@ -3,10 +3,10 @@ package main
 import (
 	"github.com/digitalocean/godo"
 	"golang.org/x/oauth2"
+	"net/url"
+	"time"
 )
 
-var doClient *godo.Client
-
 type TokenSource struct {
 	AccessToken string
 }
@@ -18,11 +18,140 @@ func (t *TokenSource) Token() (*oauth2.Token, error) {
 	return token, nil
 }
 
-func loadDoClient() {
+type digitalOceanProvider struct {
+	client *godo.Client
+}
+
+func newDigitalOceanProvider(config Config) (Provider, error) {
+	return newDigitalOceanProviderWithURL(config.APIToken, "")
+}
+
+// newDigitalOceanProviderWithURL creates a DigitalOcean provider which talks
+// to the API at baseURL instead, such as a fakeDigitalOcean. An empty
+// baseURL uses the real API.
+func newDigitalOceanProviderWithURL(token string,
+	baseURL string) (Provider, error) {
 	tokenSource := &TokenSource{
-		AccessToken: globalConfig.APIToken,
+		AccessToken: token,
 	}
 
 	oauthClient := oauth2.NewClient(oauth2.NoContext, tokenSource)
-	doClient = godo.NewClient(oauthClient)
+	client := godo.NewClient(oauthClient)
+
+	if baseURL != "" {
+		parsedURL, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, err
+		}
+
+		client.BaseURL = parsedURL
+	}
+
+	return &digitalOceanProvider{client: client}, nil
+}
+
+func (p *digitalOceanProvider) listOptions() *godo.ListOptions {
+	return &godo.ListOptions{
+		Page:    1,
+		PerPage: 100,
+	}
+}
+
+func (p *digitalOceanProvider) ListMachines() ([]Machine, error) {
+	droplets, _, err := p.client.Droplets.List(p.listOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	machines := make([]Machine, len(droplets))
+	for i, droplet := range droplets {
+		machines[i] = Machine{
+			ID:     droplet.ID,
+			Name:   droplet.Name,
+			Status: droplet.Status,
+		}
+
+		machines[i].Created, _ = time.Parse(time.RFC3339, droplet.Created)
+
+		if droplet.Networks != nil && len(droplet.Networks.V4) > 0 {
+			machines[i].IPAddress = droplet.Networks.V4[0].IPAddress
+		}
+	}
+
+	return machines, nil
+}
+
+func (p *digitalOceanProvider) CreateMachine(req CreateRequest) error {
+	createRequest := &godo.DropletCreateRequest{
+		Name:   req.Name,
+		Region: req.Region,
+		Size:   req.Size,
+		Image: godo.DropletCreateImage{
+			ID: req.ImageID,
+		},
+		SSHKeys: []godo.DropletCreateSSHKey{
+			godo.DropletCreateSSHKey{
+				Fingerprint: req.SSHFingerprint,
+			},
+		},
+	}
+
+	_, _, err := p.client.Droplets.Create(createRequest)
+	return err
+}
+
+func (p *digitalOceanProvider) DeleteMachine(machineID int) error {
+	_, err := p.client.Droplets.Delete(machineID)
+	return err
+}
+
+func (p *digitalOceanProvider) PowerOff(machineID int) error {
+	_, _, err := p.client.DropletActions.PowerOff(machineID)
+	return err
+}
+
+func (p *digitalOceanProvider) Snapshot(machineID int, name string) error {
+	_, _, err := p.client.DropletActions.Snapshot(machineID, name)
+	return err
+}
+
+func (p *digitalOceanProvider) ListImages() ([]Image, error) {
+	snapshots, _, err := p.client.Images.ListUser(p.listOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]Image, len(snapshots))
+	for i, snapshot := range snapshots {
+		images[i] = Image{ID: snapshot.ID, Name: snapshot.Name}
+	}
+
+	return images, nil
+}
+
+func (p *digitalOceanProvider) DeleteImage(imageID int) error {
+	_, err := p.client.Images.Delete(imageID)
+	return err
+}
+
+func (p *digitalOceanProvider) ListActions(machineID int) ([]Action, error) {
+	actions, _, err := p.client.Droplets.Actions(machineID, p.listOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Action, len(actions))
+	for i, action := range actions {
+		results[i] = Action{
+			ID:     action.ID,
+			Type:   action.Type,
+			Status: action.Status,
+		}
+
+		if action.StartedAt != nil {
+			results[i].StartedAt = action.StartedAt.Time
+		}
+	}
+
+	return results, nil
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/digitalocean/godo"
 	"time"
 )
 
@@ -17,28 +16,29 @@ const (
 
 func startDropletMonitor() {
 	for {
-		delay := runDropletCheck()
+		delay := runDropletCheck(isLeader())
 		time.Sleep(delay)
 	}
 }
 
-func runDropletCheck() (delay time.Duration) {
+// runDropletCheck updates the servers from the state of their droplets, and
+// returns how long to wait until the next check. Only the leader acts on the
+// droplets. Standby reverse proxies only record their addresses and states,
+// so that they can accept reports from backends and are up to date when they
+// take over.
+func runDropletCheck(leading bool) (delay time.Duration) {
 	delay = time.Second * 30
 
-	serverPrefixes := make([]string, len(allServers))
-
-	for i, server := range allServers {
+	for _, server := range allServers {
 		if server.Available {
 			server.StateLock.Lock()
 			defer server.StateLock.Unlock()
 		}
-
-		serverPrefixes[i] = server.Name
 	}
 
-	droplets, err := getDropletsList(serverPrefixes)
+	droplets, err := getDropletsList(allServers)
 	if err != nil {
-		Log("droplet monitor", "Failed to get droplet list:", err)
+		Warn("droplet monitor", "Failed to get droplet list:", err)
 		return time.Second * 10
 	}
 
@@ -49,39 +49,46 @@ func runDropletCheck() (delay time.Duration) {
 		}
 
 		if !droplet.exists {
-			server.SetState(stateOff)
+			server.DropletCreated = time.Time{}
+			server.observeState(stateOff)
 			continue
 		}
 
-		server.IPAddress = droplet.Networks.V4[0].IPAddress
+		server.IPAddress = droplet.IPAddress
 		server.DropletId = droplet.ID
+		server.DropletCreated = droplet.Created
 
 		if droplet.Status == "off" && server.State == stateShutdown {
-			go server.Snapshot()
+			if leading {
+				go server.Snapshot()
+			}
 			continue
 		}
 
 		if droplet.Status == "active" && server.State == stateSnapshot {
-			go server.Destroy()
+			if leading {
+				go server.Destroy()
+			}
 			continue
 		}
 
 		if droplet.Status == "active" && server.State == stateShutdown &&
 			time.Now().After(server.ShutdownDeadline) {
-			go server.ForceShutdown()
+			if leading {
+				go server.ForceShutdown()
+			}
 			continue
 		}
 
-		if server.IsMinecraftServerResponding() &&
-			server.State != stateShutdown && server.State != stateSnapshot &&
-			server.State != stateDestroy {
+		if server.CanTransition(stateStarted) && !server.heartbeatStale() &&
+			server.IsMinecraftServerResponding() {
 			server.SetState(stateStarted)
 			continue
 		}
 
 		event, err := getRunningAction(server, droplet.Status)
 		if err != nil {
-			server.Log("droplet monitor", "Failed to get running event:", err)
+			server.Warn("droplet monitor", "Failed to get running event:", err)
 			server.SetState(stateUnavailable)
 			continue
 		}
@@ -90,31 +97,50 @@ func runDropletCheck() (delay time.Duration) {
 		case actionUnknown:
 			server.SetState(stateUnavailable)
 		case actionSnapshot:
-			server.SetState(stateSnapshot)
+			if server.Operation == operationLiveSnapshot {
+				// The droplet keeps running during a live snapshot.
+				break
+			}
+
+			server.observeState(stateSnapshot)
 			delay = time.Second * 10
 		case actionShuttingDown:
-			server.SetState(stateShutdown)
+			server.observeState(stateShutdown)
 			delay = time.Second * 10
 		case actionDestroy:
-			server.SetState(stateDestroy)
+			server.observeState(stateDestroy)
 			delay = time.Second * 10
 		case actionCreate:
-			server.SetState(stateStarting)
+			server.observeState(stateStarting)
+			server.setStartupPhase(phaseCreatingDroplet)
 			delay = time.Second * 10
 		case actionErrored:
+			if server.State == stateStarting && leading {
+				// The provider failed to create the droplet.
+				server.countActionFailure("restore")
+			}
+
 			server.SetState(stateUnavailable)
 		case actionRunning:
 			if server.State == stateSnapshot {
-				go server.Destroy()
+				if leading {
+					go server.Destroy()
+				}
 				break
 			}
 
 			if server.IsMinecraftServerRunning() {
 				server.SetState(stateStarting)
-			} else {
-				if server.State != stateStarting {
-					server.SetState(stateUnavailable)
+				server.setStartupPhase(phaseStartingJava)
+			} else if server.State == stateStarting {
+				// The backend isn't up yet, unless it is restarting
+				// Minecraft.
+				if server.StartupPhase != phaseRestarting {
+					server.setStartupPhase(phaseBootingOS)
 				}
+				delay = time.Second * 10
+			} else if server.State != stateCrashed {
+				server.SetState(stateUnavailable)
 			}
 		}
 	}
@@ -123,31 +149,33 @@ func runDropletCheck() (delay time.Duration) {
 }
 
 type dropletState struct {
-	godo.Droplet
+	Machine
 	exists bool
 }
 
-func getDropletsList(dropletPrefixes []string) ([]dropletState, error) {
-	opt := &godo.ListOptions{
-		Page:    1,
-		PerPage: 100,
-	}
+func getDropletsList(servers []*Server) ([]dropletState, error) {
+	// Servers sharing a provider share a single listing.
+	machinesByProvider := make(map[Provider][]Machine)
 
-	var droplets []godo.Droplet
+	var automatedDroplets []dropletState
 
-	droplets, _, err := doClient.Droplets.List(opt)
-	if err != nil {
-		return []dropletState{}, err
-	}
+	for _, server := range servers {
+		machines, listed := machinesByProvider[server.Provider]
+		if !listed {
+			var err error
+			machines, err = server.Provider.ListMachines()
+			if err != nil {
+				return []dropletState{}, err
+			}
 
-	var automatedDroplets []dropletState
+			machinesByProvider[server.Provider] = machines
+		}
 
-	for _, prefix := range dropletPrefixes {
 		found := false
 
-		for _, droplet := range droplets {
-			if droplet.Name == prefix+"-automated" {
-				dropletInfo := dropletState{Droplet: droplet, exists: true}
+		for _, machine := range machines {
+			if machine.Name == server.Name+"-automated" {
+				dropletInfo := dropletState{Machine: machine, exists: true}
 				automatedDroplets = append(automatedDroplets, dropletInfo)
 				found = true
 				break
@@ -164,15 +192,14 @@ func getDropletsList(dropletPrefixes []string) ([]dropletState, error) {
 }
 
 func getRunningAction(server *Server, dropletStatus string) (int, error) {
-	opt := &godo.ListOptions{
-		Page:    1,
-		PerPage: 100,
-	}
-	actions, _, err := doClient.Droplets.Actions(server.DropletId, opt)
+	actions, err := server.Provider.ListActions(server.DropletId)
 	if err != nil {
 		return 0, err
 	}
 
+	if len(actions) == 0 {
+		return actionUnknown, nil
+	}
 	// Issues with the most recent action takes priority over whether the
 	// the droplet is active or not.
 	if actions[0].Status == "errored" {
@@ -201,7 +228,7 @@ func getRunningAction(server *Server, dropletStatus string) (int, error) {
 		}
 	case "destroy":
 		return actionDestroy, nil
-	case "shutdown":
+	case "shutdown", "power_off":
 		return actionShuttingDown, nil
 	}
 
@@ -0,0 +1,804 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/1lann/dynamicserver/control"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDigitalOcean is a local stand-in for the subset of the DigitalOcean v2
+// API used by the digitalocean provider. Droplet actions complete after a
+// simulated latency, and failures can be injected per endpoint or per action
+// type.
+type fakeDigitalOcean struct {
+	// IPAddress is assigned to every created droplet.
+	IPAddress string
+	// Latencies is how long each action type stays in progress for.
+	// Missing action types complete after a second.
+	Latencies map[string]time.Duration
+
+	lock          *sync.Mutex
+	nextID        int
+	droplets      map[int]*fakeDroplet
+	images        map[int]Image
+	failRequests  map[string]int
+	errorActions  map[string]int
+	requestCounts map[string]int
+}
+
+type fakeDroplet struct {
+	ID      int
+	Name    string
+	Status  string
+	Created time.Time
+	Actions []*fakeAction
+}
+
+type fakeAction struct {
+	ID        int       `json:"id"`
+	Status    string    `json:"status"`
+	Type      string    `json:"type"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type fakeError struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+func newFakeDigitalOcean(ipAddress string) *fakeDigitalOcean {
+	return &fakeDigitalOcean{
+		IPAddress:     ipAddress,
+		Latencies:     make(map[string]time.Duration),
+		lock:          &sync.Mutex{},
+		nextID:        1000,
+		droplets:      make(map[int]*fakeDroplet),
+		images:        make(map[int]Image),
+		failRequests:  make(map[string]int),
+		errorActions:  make(map[string]int),
+		requestCounts: make(map[string]int),
+	}
+}
+
+// FailRequests makes the next count requests to endpoint fail with a server
+// error. Endpoints are the method and a path pattern, such as
+// "POST /v2/droplets" or "POST /v2/droplets/:id/actions".
+func (f *fakeDigitalOcean) FailRequests(endpoint string, count int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failRequests[endpoint] += count
+}
+
+// ErrorActions makes the next count actions of actionType end as errored
+// instead of completing.
+func (f *fakeDigitalOcean) ErrorActions(actionType string, count int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.errorActions[actionType] += count
+}
+
+// RequestCount returns the number of requests received for endpoint.
+func (f *fakeDigitalOcean) RequestCount(endpoint string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requestCounts[endpoint]
+}
+
+// AddImage adds a user image, such as a snapshot to restore from.
+func (f *fakeDigitalOcean) AddImage(name string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.nextID++
+	f.images[f.nextID] = Image{ID: f.nextID, Name: name}
+	return f.nextID
+}
+
+func (f *fakeDigitalOcean) Images() []Image {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	images := make([]Image, 0, len(f.images))
+	for _, image := range f.images {
+		images = append(images, image)
+	}
+
+	return images
+}
+
+// DropletStatus returns the status of the droplet with the given name, and
+// whether it exists.
+func (f *fakeDigitalOcean) DropletStatus(name string) (string, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, droplet := range f.droplets {
+		if droplet.Name == name {
+			return droplet.Status, true
+		}
+	}
+
+	return "", false
+}
+
+// GuestShutdown simulates the operating system of a droplet powering itself
+// off, which does not register as an action.
+func (f *fakeDigitalOcean) GuestShutdown(dropletID int) {
+	latency := f.latency("shutdown")
+	time.AfterFunc(latency, func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		if droplet, found := f.droplets[dropletID]; found {
+			droplet.Status = "off"
+		}
+	})
+}
+
+// RemoveDroplet removes a droplet without going through the API.
+func (f *fakeDigitalOcean) RemoveDroplet(name string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for id, droplet := range f.droplets {
+		if droplet.Name == name {
+			delete(f.droplets, id)
+		}
+	}
+}
+
+func (f *fakeDigitalOcean) latency(actionType string) time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if latency, found := f.Latencies[actionType]; found {
+		return latency
+	}
+
+	return time.Second
+}
+
+// startAction must be called with the lock held. onComplete is called with
+// the lock held once the action completes successfully.
+func (f *fakeDigitalOcean) startAction(droplet *fakeDroplet, actionType string,
+	onComplete func()) *fakeAction {
+	f.nextID++
+	action := &fakeAction{
+		ID:        f.nextID,
+		Status:    "in-progress",
+		Type:      actionType,
+		StartedAt: time.Now().UTC(),
+	}
+
+	willError := f.errorActions[actionType] > 0
+	if willError {
+		f.errorActions[actionType]--
+	}
+
+	// Most recent first.
+	droplet.Actions = append([]*fakeAction{action}, droplet.Actions...)
+
+	latency, found := f.Latencies[actionType]
+	if !found {
+		latency = time.Second
+	}
+
+	time.AfterFunc(latency, func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		if willError {
+			action.Status = "errored"
+			return
+		}
+
+		action.Status = "completed"
+		onComplete()
+	})
+
+	return action
+}
+
+func (f *fakeDigitalOcean) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v2" {
+		f.writeError(w, http.StatusNotFound, "not_found",
+			"The resource you were accessing could not be found.")
+		return
+	}
+
+	var id int
+	pattern := make([]string, len(parts))
+	for i, part := range parts {
+		if value, err := strconv.Atoi(part); err == nil {
+			id = value
+			pattern[i] = ":id"
+		} else {
+			pattern[i] = part
+		}
+	}
+
+	endpoint := r.Method + " /" + strings.Join(pattern, "/")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requestCounts[endpoint]++
+
+	if f.failRequests[endpoint] > 0 {
+		f.failRequests[endpoint]--
+		f.writeError(w, http.StatusInternalServerError, "server_error",
+			"Injected failure.")
+		return
+	}
+
+	switch endpoint {
+	case "GET /v2/droplets":
+		f.listDroplets(w)
+	case "POST /v2/droplets":
+		f.createDroplet(w, r)
+	case "DELETE /v2/droplets/:id":
+		f.deleteDroplet(w, id)
+	case "GET /v2/droplets/:id/actions":
+		f.listActions(w, id)
+	case "POST /v2/droplets/:id/actions":
+		f.createAction(w, r, id)
+	case "GET /v2/images":
+		f.listImages(w)
+	case "DELETE /v2/images/:id":
+		f.deleteImage(w, id)
+	default:
+		f.writeError(w, http.StatusNotFound, "not_found",
+			"The resource you were accessing could not be found.")
+	}
+}
+
+func (f *fakeDigitalOcean) writeJSON(w http.ResponseWriter, status int,
+	value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func (f *fakeDigitalOcean) writeError(w http.ResponseWriter, status int,
+	id string, message string) {
+	f.writeJSON(w, status, fakeError{ID: id, Message: message})
+}
+
+func (f *fakeDigitalOcean) dropletJSON(droplet *fakeDroplet) interface{} {
+	return map[string]interface{}{
+		"id":         droplet.ID,
+		"name":       droplet.Name,
+		"status":     droplet.Status,
+		"created_at": droplet.Created.Format(time.RFC3339),
+		"networks": map[string]interface{}{
+			"v4": []map[string]interface{}{
+				{
+					"ip_address": f.IPAddress,
+					"type":       "public",
+				},
+			},
+		},
+	}
+}
+
+func (f *fakeDigitalOcean) listDroplets(w http.ResponseWriter) {
+	droplets := []interface{}{}
+	for _, droplet := range f.droplets {
+		droplets = append(droplets, f.dropletJSON(droplet))
+	}
+
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"droplets": droplets,
+		"meta":     map[string]int{"total": len(droplets)},
+	})
+}
+
+func (f *fakeDigitalOcean) createDroplet(w http.ResponseWriter,
+	r *http.Request) {
+	var request struct {
+		Name  string      `json:"name"`
+		Image interface{} `json:"image"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		f.writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	imageID, ok := request.Image.(float64)
+	if _, found := f.images[int(imageID)]; !ok || !found {
+		f.writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity",
+			"You specified an invalid image for Droplet creation.")
+		return
+	}
+
+	f.nextID++
+	droplet := &fakeDroplet{
+		ID:      f.nextID,
+		Name:    request.Name,
+		Status:  "new",
+		Created: time.Now(),
+	}
+	f.droplets[droplet.ID] = droplet
+
+	f.startAction(droplet, "create", func() {
+		droplet.Status = "active"
+	})
+
+	f.writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"droplet": f.dropletJSON(droplet),
+	})
+}
+
+func (f *fakeDigitalOcean) deleteDroplet(w http.ResponseWriter, id int) {
+	if _, found := f.droplets[id]; !found {
+		f.writeError(w, http.StatusNotFound, "not_found",
+			"The resource you were accessing could not be found.")
+		return
+	}
+
+	delete(f.droplets, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeDigitalOcean) listActions(w http.ResponseWriter, id int) {
+	droplet, found := f.droplets[id]
+	if !found {
+		f.writeError(w, http.StatusNotFound, "not_found",
+			"The resource you were accessing could not be found.")
+		return
+	}
+
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"actions": droplet.Actions,
+		"meta":    map[string]int{"total": len(droplet.Actions)},
+	})
+}
+
+func (f *fakeDigitalOcean) createAction(w http.ResponseWriter,
+	r *http.Request, id int) {
+	droplet, found := f.droplets[id]
+	if !found {
+		f.writeError(w, http.StatusNotFound, "not_found",
+			"The resource you were accessing could not be found.")
+		return
+	}
+
+	var request struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		f.writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	var action *fakeAction
+
+	switch request.Type {
+	case "power_off", "shutdown":
+		action = f.startAction(droplet, request.Type, func() {
+			droplet.Status = "off"
+		})
+	case "snapshot":
+		if droplet.Status != "off" {
+			f.writeError(w, http.StatusUnprocessableEntity,
+				"unprocessable_entity", "Droplet must be powered off.")
+			return
+		}
+
+		action = f.startAction(droplet, "snapshot", func() {
+			f.nextID++
+			f.images[f.nextID] = Image{ID: f.nextID, Name: request.Name}
+			// Droplets are powered back on after a snapshot.
+			droplet.Status = "active"
+		})
+	default:
+		f.writeError(w, http.StatusUnprocessableEntity,
+			"unprocessable_entity", "Unsupported action type.")
+		return
+	}
+
+	f.writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"action": action,
+	})
+}
+
+func (f *fakeDigitalOcean) listImages(w http.ResponseWriter) {
+	images := []interface{}{}
+	for _, image := range f.images {
+		images = append(images, map[string]interface{}{
+			"id":     image.ID,
+			"name":   image.Name,
+			"type":   "snapshot",
+			"public": false,
+		})
+	}
+
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"images": images,
+		"meta":   map[string]int{"total": len(images)},
+	})
+}
+
+func (f *fakeDigitalOcean) deleteImage(w http.ResponseWriter, id int) {
+	if _, found := f.images[id]; !found {
+		f.writeError(w, http.StatusNotFound, "not_found",
+			"The resource you were accessing could not be found.")
+		return
+	}
+
+	delete(f.images, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const testServerName = "test"
+
+// fakeBackend is a backend speaking the current control protocol, which
+// runs Minecraft whenever its droplet is active and it hasn't been stopped.
+type fakeBackend struct {
+	fake     *fakeDigitalOcean
+	server   *Server
+	lock     *sync.Mutex
+	stopped  bool
+	listener net.Listener
+}
+
+// running returns whether Minecraft would be running on the droplet.
+func (b *fakeBackend) running() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	status, exists := b.fake.DropletStatus(testServerName + "-automated")
+	return exists && status == "active" && !b.stopped
+}
+
+func (b *fakeBackend) serveComm() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go b.handleComm(conn)
+	}
+}
+
+func (b *fakeBackend) handleComm(conn net.Conn) {
+	defer conn.Close()
+
+	remote := control.NewConn(conn, b.server.auth)
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	state := "stopped"
+	if b.running() {
+		state = "started"
+	}
+
+	hello, err := control.NewMessage(control.TypeHello,
+		control.StateData{State: state})
+	if err != nil || remote.Send(hello) != nil {
+		return
+	}
+
+	request, err := remote.Receive()
+	if err != nil {
+		return
+	}
+
+	switch request.Type {
+	case control.TypeStop:
+		b.lock.Lock()
+		b.stopped = true
+		b.lock.Unlock()
+
+		ack, _ := request.Ack(control.CommandResultData{
+			Method: "rcon",
+			Saved:  true,
+		})
+		remote.Send(ack)
+		b.server.notifyMinecraftStopped()
+	case control.TypeShutdown:
+		ack, _ := request.Ack(control.CommandResultData{Method: "command"})
+		remote.Send(ack)
+		b.fake.GuestShutdown(b.server.DropletId)
+	default:
+		remote.Send(request.Reject("unknown message type"))
+	}
+}
+
+// serveMinecraft answers status pings while Minecraft is running.
+func (b *fakeBackend) serveMinecraft(listener net.Listener) {
+	status := `{"version":{"name":"test","protocol":5},` +
+		`"players":{"max":1,"online":0},"description":{"text":"test"}}`
+
+	// Packet ID 0x00 followed by the status as a string.
+	packet := append([]byte{0x00}, appendVarInt(nil, len(status))...)
+	packet = append(packet, status...)
+	response := append(appendVarInt(nil, len(packet)), packet...)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+
+			if !b.running() {
+				return
+			}
+
+			conn.SetDeadline(time.Now().Add(time.Second * 5))
+			bufio.NewReader(conn).Peek(1)
+			conn.Write(response)
+		}(conn)
+	}
+}
+
+func appendVarInt(data []byte, value int) []byte {
+	for value >= 0x80 {
+		data = append(data, byte(value)|0x80)
+		value >>= 7
+	}
+
+	return append(data, byte(value))
+}
+
+// listenLocal listens on a random port on localhost for the rest of the
+// test, and returns the port.
+func listenLocal(t *testing.T) (net.Listener, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return listener, port
+}
+
+// newTestServer creates a server with three snapshots, backed by a fake
+// DigitalOcean API and a fake backend, and waits for it to be off.
+func newTestServer(t *testing.T) (*Server, *fakeDigitalOcean,
+	*fakeBackend) {
+	failureWait = time.Millisecond * 50
+	actionCooldown = time.Millisecond * 100
+
+	fake := newFakeDigitalOcean("127.0.0.1")
+	fake.Latencies["create"] = time.Millisecond * 500
+	fake.Latencies["shutdown"] = time.Millisecond * 300
+	fake.Latencies["power_off"] = time.Millisecond * 300
+	fake.Latencies["snapshot"] = time.Millisecond * 500
+
+	api := httptest.NewServer(fake)
+	t.Cleanup(api.Close)
+
+	provider, err := newDigitalOceanProviderWithURL("test", api.URL+"/")
+	if err != nil {
+		t.Fatal("failed to create provider:", err)
+	}
+
+	server := &Server{
+		StateLock: &sync.Mutex{},
+		Provider:  provider,
+		auth:      control.NewAuthenticator(""),
+	}
+	server.Name = testServerName
+	server.Available = true
+	server.SetState(stateInitializing)
+	allServers = []*Server{server}
+
+	backend := &fakeBackend{
+		fake:   fake,
+		server: server,
+		lock:   &sync.Mutex{},
+	}
+
+	backend.listener, globalConfig.CommunicationsPort = listenLocal(t)
+	go backend.serveComm()
+
+	var minecraftListener net.Listener
+	minecraftListener, minecraftPort = listenLocal(t)
+	go backend.serveMinecraft(minecraftListener)
+
+	snapshotTime := time.Now().Unix() - 3600
+	for i := 0; i < 3; i++ {
+		fake.AddImage(testServerName + "-" +
+			strconv.FormatInt(snapshotTime+int64(i), 10))
+	}
+
+	waitForState(t, server, stateOff, time.Second*5)
+	return server, fake, backend
+}
+
+func (b *fakeBackend) start() {
+	b.lock.Lock()
+	b.stopped = false
+	b.lock.Unlock()
+	go b.server.Restore()
+}
+
+// waitForState runs the droplet monitor until the server is in the expected
+// state.
+func waitForState(t *testing.T, server *Server, expect state,
+	timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		runDropletCheck(true)
+		if server.CurrentState() == expect {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	t.Fatal("expected state", expect, "but was", server.CurrentState())
+}
+
+// expectTransitions checks the server's transitions since the given number of
+// transitions, and returns the number of transitions.
+func expectTransitions(t *testing.T, server *Server, since int,
+	expect ...state) int {
+	t.Helper()
+
+	history := server.TransitionHistory()[since:]
+	var got []string
+	for _, transition := range history {
+		got = append(got, transition.From.String()+"->"+
+			transition.To.String())
+	}
+
+	var want []string
+	for i := 1; i < len(expect); i++ {
+		want = append(want, expect[i-1].String()+"->"+expect[i].String())
+	}
+
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("expected transitions %v, but got %v", want, got)
+	}
+
+	return since + len(history)
+}
+
+func TestDropletLifecycle(t *testing.T) {
+	server, fake, backend := newTestServer(t)
+	mark := len(server.TransitionHistory())
+
+	backend.start()
+	waitForState(t, server, stateStarted, time.Second*10)
+
+	go server.Shutdown()
+	waitForState(t, server, stateOff, time.Second*15)
+
+	expectTransitions(t, server, mark, stateOff, stateStarting, stateStarted,
+		stateShutdown, stateSnapshot, stateDestroy, stateOff)
+
+	// The two most recent snapshots are kept along with the new one.
+	if images := fake.Images(); len(images) != 3 {
+		t.Error("expected 3 snapshots to be kept, but found", len(images))
+	}
+}
+
+func TestDropletMonitorRetriesFailedRequests(t *testing.T) {
+	server, fake, backend := newTestServer(t)
+	mark := len(server.TransitionHistory())
+
+	fake.FailRequests("GET /v2/images", 1)
+	fake.FailRequests("POST /v2/droplets", 2)
+	backend.start()
+	waitForState(t, server, stateStarted, time.Second*10)
+
+	if count := fake.RequestCount("POST /v2/droplets"); count != 3 {
+		t.Error("expected 3 requests to create the droplet, but got", count)
+	}
+
+	fake.FailRequests("POST /v2/droplets/:id/actions", 1)
+	fake.FailRequests("DELETE /v2/images/:id", 1)
+	go server.Shutdown()
+	waitForState(t, server, stateOff, time.Second*15)
+
+	expectTransitions(t, server, mark, stateOff, stateStarting, stateStarted,
+		stateShutdown, stateSnapshot, stateDestroy, stateOff)
+
+	// The two most recent snapshots are kept along with the new one.
+	if images := fake.Images(); len(images) != 3 {
+		t.Error("expected 3 snapshots to be kept, but found", len(images))
+	}
+}
+
+func TestDropletMonitorErroredCreate(t *testing.T) {
+	server, fake, backend := newTestServer(t)
+	mark := len(server.TransitionHistory())
+
+	fake.ErrorActions("create", 1)
+	backend.start()
+	waitForState(t, server, stateUnavailable, time.Second*10)
+
+	fake.RemoveDroplet(testServerName + "-automated")
+	waitForState(t, server, stateOff, time.Second*5)
+
+	expectTransitions(t, server, mark, stateOff, stateStarting,
+		stateUnavailable, stateOff)
+}
+
+// setLeader makes this reverse proxy the leader or a standby until the end
+// of the test.
+func setLeader(t *testing.T, leading bool) {
+	leaderMutex.Lock()
+	leader = leading
+	leaderMutex.Unlock()
+
+	t.Cleanup(func() {
+		leaderMutex.Lock()
+		leader = true
+		leaderMutex.Unlock()
+	})
+}
+
+func TestStandbyDropletCheck(t *testing.T) {
+	server, fake, backend := newTestServer(t)
+
+	backend.start()
+	waitForState(t, server, stateStarted, time.Second*10)
+
+	// Standby reverse proxies learn the droplet's address, so that they
+	// accept reports from the backend.
+	setLeader(t, false)
+	server.StateLock.Lock()
+	server.IPAddress = ""
+	server.StateLock.Unlock()
+
+	runDropletCheck(false)
+	if server.IPAddress != fake.IPAddress {
+		t.Fatalf("expected IP address %q, but got %q", fake.IPAddress,
+			server.IPAddress)
+	}
+
+	// The droplet powering off during a shutdown is left for the leader.
+	server.StateLock.Lock()
+	server.observeState(stateShutdown)
+	server.StateLock.Unlock()
+
+	fake.GuestShutdown(server.DropletId)
+	for i := 0; i < 100; i++ {
+		if status, _ := fake.DropletStatus(testServerName +
+			"-automated"); status == "off" {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	actions := fake.RequestCount("POST /v2/droplets/:id/actions")
+	for i := 0; i < 3; i++ {
+		runDropletCheck(false)
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	if count := fake.RequestCount("POST /v2/droplets/:id/actions"); count !=
+		actions {
+		t.Error("expected no droplet actions on standby, but got",
+			count-actions)
+	}
+
+	if current := server.CurrentState(); current != stateShutdown {
+		t.Fatal("expected state", stateShutdown, "on standby, but was",
+			current)
+	}
+
+	// The leader snapshots and destroys the droplet.
+	setLeader(t, true)
+	waitForState(t, server, stateOff, time.Second*15)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/1lann/dynamicserver/control"
+	"time"
+)
+
+const defaultHeartbeatTimeout = time.Minute
+
+func (s *Server) heartbeatTimeout() time.Duration {
+	if s.HeartbeatTimeoutSeconds > 0 {
+		return time.Duration(s.HeartbeatTimeoutSeconds) * time.Second
+	}
+
+	return defaultHeartbeatTimeout
+}
+
+// heartbeatStale returns whether the backend has stopped sending heartbeats.
+// Backends which have never sent a heartbeat since the droplet was started,
+// such as legacy backends, are never considered stale.
+func (s *Server) heartbeatStale() bool {
+	return !s.LastHeartbeat.IsZero() &&
+		time.Now().Sub(s.LastHeartbeat) > s.heartbeatTimeout()
+}
+
+func (s *Server) receiveHeartbeat(heartbeat control.HeartbeatData) {
+	s.Heartbeat = heartbeat
+	s.LastHeartbeat = time.Now()
+
+	if heartbeat.OnlinePlayers >= 0 {
+		s.PingStatus.OnlinePlayers = heartbeat.OnlinePlayers
+	}
+}
+
+// onlinePlayers returns the number of players the backend reports to be
+// online, or -1 if it is unknown.
+func (s *Server) onlinePlayers() int {
+	if s.LastHeartbeat.IsZero() || s.heartbeatStale() {
+		return -1
+	}
+
+	return s.Heartbeat.OnlinePlayers
+}
+
+// resetHeartbeatHook forgets heartbeats of previous droplets.
+func resetHeartbeatHook(s *Server, from state, to state) {
+	if to == stateOff || to == stateStarting {
+		s.Heartbeat = control.HeartbeatData{}
+		s.LastHeartbeat = time.Time{}
+		s.PingStatus.OnlinePlayers = 0
+	}
+}
+
+func checkHeartbeat(server *Server) {
+	if server.State == stateStarted && server.heartbeatStale() {
+		server.Log("heartbeat", "No heartbeat received since",
+			server.LastHeartbeat.Format(time.RFC3339)+".")
+		server.SetState(stateUnavailable)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The state journal records the lifecycle state of every server on disk
+// whenever it changes, so that a restarted reverse proxy can resume any
+// shutdown, snapshot or destroy that was in progress.
+
+const (
+	operationNone         = ""
+	operationRestore      = "restore"
+	operationShutdown     = "shutdown"
+	operationSnapshot     = "snapshot"
+	operationLiveSnapshot = "live_snapshot"
+	operationDestroy      = "destroy"
+)
+
+type journalEntry struct {
+	State              state     `json:"state"`
+	DropletId          int       `json:"droplet_id"`
+	ShutdownDeadline   time.Time `json:"shutdown_deadline"`
+	LastConnectionTime time.Time `json:"last_connection_time"`
+	Operation          string    `json:"operation"`
+	OperationStarted   time.Time `json:"operation_started"`
+	Maintenance        bool      `json:"maintenance"`
+	Updated            time.Time `json:"updated"`
+}
+
+var journalLock = &sync.Mutex{}
+
+// journalPath is empty if the journal is disabled, such as in tests.
+var journalPath string
+
+func loadJournalPath(config Config) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		Fatal("journal", "Could not resolve filepath:", err)
+	}
+
+	journalPath = config.StateJournal
+	if journalPath == "" {
+		journalPath = "state.json"
+	}
+
+	if !filepath.IsAbs(journalPath) {
+		journalPath = filepath.Join(dir, journalPath)
+	}
+}
+
+func readJournal() (map[string]journalEntry, error) {
+	entries := make(map[string]journalEntry)
+
+	data, err := ioutil.ReadFile(journalPath)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &entries)
+	return entries, err
+}
+
+// writeJournal writes the current state of all servers to the journal. Only
+// the leader writes the journal, as standby reverse proxies share it.
+func writeJournal() {
+	if journalPath == "" || !isLeader() {
+		return
+	}
+
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	entries := make(map[string]journalEntry)
+	for _, server := range allServers {
+		entries[server.Name] = journalEntry{
+			State:              server.State,
+			DropletId:          server.DropletId,
+			ShutdownDeadline:   server.ShutdownDeadline,
+			LastConnectionTime: server.LastConnectionTime,
+			Operation:          server.Operation,
+			OperationStarted:   server.OperationStarted,
+			Maintenance:        server.Maintenance,
+			Updated:            time.Now(),
+		}
+	}
+
+	data, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		Warn("journal", "Failed to encode state journal:", err)
+		return
+	}
+
+	// Write to a temporary file first so that a crash never leaves a
+	// partially written journal behind.
+	err = ioutil.WriteFile(journalPath+".tmp", data, 0600)
+	if err != nil {
+		Warn("journal", "Failed to write state journal:", err)
+		return
+	}
+
+	err = os.Rename(journalPath+".tmp", journalPath)
+	if err != nil {
+		Warn("journal", "Failed to replace state journal:", err)
+	}
+}
+
+func journalStateHook(s *Server, from state, to state) {
+	writeJournal()
+}
+
+func (s *Server) beginOperation(operation string) {
+	s.Operation = operation
+	s.OperationStarted = time.Now()
+	writeJournal()
+}
+
+func (s *Server) endOperation() {
+	s.Operation = operationNone
+	s.OperationStarted = time.Time{}
+	writeJournal()
+}
+
+// resumeFromJournal checks the droplets without acting on them, and then
+// replays the journal, so that operations are resumed against the current
+// addresses and states of the droplets. It must be called after the
+// providers have been loaded, and is called again when a standby reverse
+// proxy becomes the leader to resume the operations of the previous leader.
+func resumeFromJournal() {
+	runDropletCheck(false)
+	replayJournal()
+}
+
+// replayJournal restores the state of servers from the journal, and resumes
+// any operation that was in progress.
+func replayJournal() {
+	entries, err := readJournal()
+	if err != nil {
+		Warn("journal", "Failed to read state journal, ignoring it:", err)
+		return
+	}
+
+	for _, server := range allServers {
+		entry, found := entries[server.Name]
+		if !found {
+			continue
+		}
+
+		if entry.Maintenance {
+			server.SetMaintenance(true)
+		}
+
+		if !server.Available {
+			continue
+		}
+
+		// The monitors may already be running after a change of leader.
+		server.StateLock.Lock()
+		server.replayJournalEntry(entry)
+		server.StateLock.Unlock()
+	}
+
+	writeJournal()
+}
+
+func (s *Server) replayJournalEntry(entry journalEntry) {
+	// The droplet monitor knows better if it has found the droplet.
+	if s.DropletId == 0 {
+		s.DropletId = entry.DropletId
+	}
+	s.LastConnectionTime = entry.LastConnectionTime
+
+	if entry.Operation == operationLiveSnapshot {
+		// The droplet kept running, so there is nothing to resume other
+		// than cleaning up once the snapshot is done.
+		s.Log("journal", "Resuming wait for live snapshot.")
+		s.Operation = entry.Operation
+		s.OperationStarted = entry.OperationStarted
+		go s.resumeLiveSnapshot(entry.OperationStarted)
+		return
+	}
+
+	if entry.Operation != operationShutdown &&
+		entry.Operation != operationSnapshot &&
+		entry.Operation != operationDestroy {
+		// Anything else is cheaply and safely rediscovered by the droplet
+		// monitor.
+		return
+	}
+
+	if s.State == stateOff {
+		s.Log("journal", "The droplet is already gone, not resuming "+
+			"operation \""+entry.Operation+"\".")
+		return
+	}
+
+	s.Operation = entry.Operation
+	s.OperationStarted = entry.OperationStarted
+
+	var resumeState state
+
+	switch entry.Operation {
+	case operationShutdown:
+		resumeState = stateShutdown
+		if entry.ShutdownDeadline.IsZero() {
+			entry.ShutdownDeadline = time.Now().Add(time.Minute)
+		}
+	case operationSnapshot:
+		if s.snapshotRequestedSince(entry.OperationStarted) {
+			// The droplet monitor destroys the droplet once the snapshot
+			// has completed.
+			resumeState = stateSnapshot
+		} else {
+			// Go back to waiting for the power off, after which the droplet
+			// monitor will take the snapshot again.
+			s.Log("journal", "Snapshot was never requested, "+
+				"resuming from shutdown.")
+			resumeState = stateShutdown
+			s.Operation = operationShutdown
+			entry.ShutdownDeadline = time.Now().Add(time.Minute)
+		}
+	case operationDestroy:
+		resumeState = stateDestroy
+	}
+
+	s.Log("journal", "Resuming from state", resumeState,
+		"with operation \""+s.Operation+"\".")
+
+	// The journal records what the previous leader was doing to the droplet,
+	// which the transition table doesn't know about.
+	s.observeState(resumeState)
+	s.ShutdownDeadline = entry.ShutdownDeadline
+
+	if resumeState == stateDestroy {
+		go s.Destroy()
+	}
+}
+
+func (s *Server) snapshotRequestedSince(since time.Time) bool {
+	actions, err := s.Provider.ListActions(s.DropletId)
+	if err != nil {
+		s.Warn("journal", "Failed to list actions:", err)
+		// Snapshotting twice is better than destroying without one.
+		return false
+	}
+
+	// Allow for some clock skew between us and the provider.
+	since = since.Add(-time.Minute)
+
+	for _, action := range actions {
+		if action.Type == "snapshot" && !action.StartedAt.Before(since) {
+			return true
+		}
+	}
+
+	return false
+}
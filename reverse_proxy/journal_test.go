@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useJournal makes the journal the file at the path until the end of the
+// test, and writes the entry for the test server to it unless it's nil.
+func useJournal(t *testing.T, path string, entry *journalEntry) {
+	journalPath = path
+	t.Cleanup(func() { journalPath = "" })
+
+	if entry == nil {
+		return
+	}
+
+	data, err := json.Marshal(map[string]journalEntry{testServerName: *entry})
+	if err != nil {
+		t.Fatal("failed to encode journal:", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal("failed to write journal:", err)
+	}
+}
+
+// startTestServer creates a test server and starts it.
+func startTestServer(t *testing.T) (*Server, *fakeDigitalOcean) {
+	server, fake, backend := newTestServer(t)
+	backend.start()
+	waitForState(t, server, stateStarted, time.Second*10)
+
+	// Let the restore's cooldown finish.
+	server.StateLock.Lock()
+	server.StateLock.Unlock()
+
+	return server, fake
+}
+
+// operation returns the server's operation and shutdown deadline.
+func operation(server *Server) (string, time.Time) {
+	server.StateLock.Lock()
+	defer server.StateLock.Unlock()
+	return server.Operation, server.ShutdownDeadline
+}
+
+func TestJournalResumesShutdown(t *testing.T) {
+	server, _ := startTestServer(t)
+	useJournal(t, filepath.Join(t.TempDir(), "state.json"), &journalEntry{
+		State:            stateShutdown,
+		DropletId:        server.DropletId,
+		Operation:        operationShutdown,
+		OperationStarted: time.Now().Add(-time.Minute),
+	})
+
+	resumeFromJournal()
+
+	if current := server.CurrentState(); current != stateShutdown {
+		t.Fatal("expected state", stateShutdown, "but was", current)
+	}
+
+	// A shutdown without a deadline gets a new one, instead of being
+	// forced immediately.
+	op, deadline := operation(server)
+	if op != operationShutdown || time.Until(deadline) < time.Second*50 ||
+		time.Until(deadline) > time.Minute {
+		t.Fatalf("expected shutdown with a deadline in a minute, but got "+
+			"%q with a deadline in %v", op, time.Until(deadline))
+	}
+
+	// Once the deadline passes, the droplet is forced off, snapshot and
+	// destroyed.
+	mark := len(server.TransitionHistory())
+	server.StateLock.Lock()
+	server.ShutdownDeadline = time.Now()
+	server.StateLock.Unlock()
+	waitForState(t, server, stateOff, time.Second*15)
+
+	expectTransitions(t, server, mark, stateShutdown, stateSnapshot,
+		stateDestroy, stateOff)
+}
+
+func TestJournalResumesSnapshot(t *testing.T) {
+	server, fake := startTestServer(t)
+
+	started := time.Now()
+	fake.GuestShutdown(server.DropletId)
+	for i := 0; ; i++ {
+		status, _ := fake.DropletStatus(testServerName + "-automated")
+		if status == "off" {
+			break
+		} else if i > 100 {
+			t.Fatal("droplet did not power off")
+		}
+
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	err := server.Provider.Snapshot(server.DropletId, testServerName+"-1")
+	if err != nil {
+		t.Fatal("failed to snapshot:", err)
+	}
+
+	// Wait for the snapshot to complete, so that only the journal says
+	// that a snapshot was taken.
+	for i := 0; ; i++ {
+		actions, err := server.Provider.ListActions(server.DropletId)
+		if err == nil && actions[0].Status == "completed" {
+			break
+		} else if i > 100 {
+			t.Fatal("snapshot did not complete")
+		}
+
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	useJournal(t, filepath.Join(t.TempDir(), "state.json"), &journalEntry{
+		State:            stateSnapshot,
+		DropletId:        server.DropletId,
+		Operation:        operationSnapshot,
+		OperationStarted: started,
+	})
+
+	resumeFromJournal()
+
+	if current := server.CurrentState(); current != stateSnapshot {
+		t.Fatal("expected state", stateSnapshot, "but was", current)
+	}
+
+	if op, _ := operation(server); op != operationSnapshot {
+		t.Fatalf("expected operation %q, but got %q", operationSnapshot, op)
+	}
+
+	// The droplet is destroyed without taking another snapshot.
+	mark := len(server.TransitionHistory())
+	waitForState(t, server, stateOff, time.Second*15)
+	expectTransitions(t, server, mark, stateSnapshot, stateDestroy, stateOff)
+}
+
+func TestJournalSnapshotFallsBackToShutdown(t *testing.T) {
+	server, _ := startTestServer(t)
+	useJournal(t, filepath.Join(t.TempDir(), "state.json"), &journalEntry{
+		State:            stateSnapshot,
+		DropletId:        server.DropletId,
+		Operation:        operationSnapshot,
+		OperationStarted: time.Now(),
+	})
+
+	resumeFromJournal()
+
+	if current := server.CurrentState(); current != stateShutdown {
+		t.Fatal("expected state", stateShutdown, "but was", current)
+	}
+
+	op, deadline := operation(server)
+	if op != operationShutdown || deadline.IsZero() {
+		t.Fatalf("expected shutdown with a deadline, but got %q with %v",
+			op, deadline)
+	}
+}
+
+func TestJournalResumesDestroy(t *testing.T) {
+	server, fake := startTestServer(t)
+	useJournal(t, filepath.Join(t.TempDir(), "state.json"), &journalEntry{
+		State:            stateDestroy,
+		DropletId:        server.DropletId,
+		Operation:        operationDestroy,
+		OperationStarted: time.Now(),
+	})
+
+	mark := len(server.TransitionHistory())
+	resumeFromJournal()
+	waitForState(t, server, stateOff, time.Second*10)
+
+	expectTransitions(t, server, mark, stateStarted, stateDestroy, stateOff)
+	if _, exists := fake.DropletStatus(testServerName +
+		"-automated"); exists {
+		t.Error("expected the droplet to be destroyed")
+	}
+}
+
+func TestJournalIgnoresOperationsOnGoneDroplets(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	useJournal(t, filepath.Join(t.TempDir(), "state.json"), &journalEntry{
+		State:            stateDestroy,
+		DropletId:        1234,
+		Operation:        operationDestroy,
+		OperationStarted: time.Now(),
+	})
+
+	mark := len(server.TransitionHistory())
+	resumeFromJournal()
+
+	expectTransitions(t, server, mark)
+	if op, _ := operation(server); op != operationNone {
+		t.Fatalf("expected no operation, but got %q", op)
+	}
+}
+
+func TestJournalIgnoresBadJournals(t *testing.T) {
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := ioutil.WriteFile(corrupt, []byte("{\"test\": {"),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{corrupt, filepath.Join(dir, "missing.json")} {
+		server, _ := startTestServer(t)
+		useJournal(t, path, nil)
+
+		mark := len(server.TransitionHistory())
+		resumeFromJournal()
+
+		expectTransitions(t, server, mark)
+		if op, _ := operation(server); op != operationNone {
+			t.Errorf("%s: expected no operation, but got %q", path, op)
+		}
+	}
+}
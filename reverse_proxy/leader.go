@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Several reverse proxies can run as active and standby for the same
+// servers. They elect a leader through a shared lock, and only the leader
+// runs the connection monitor and lifecycle actions. Standby proxies keep
+// answering pings, tracking the state reported by backends and following the
+// droplets without acting on them, so that they are ready to take over.
+
+// LeaderLock is a lock held by at most one reverse proxy at a time.
+type LeaderLock interface {
+	// TryAcquire takes the lock if it is free, or confirms that it is still
+	// held, and returns whether this reverse proxy holds it.
+	TryAcquire() (bool, error)
+	// Release gives up the lock if it is held.
+	Release() error
+}
+
+var errUnknownLock = errors.New("leader: unknown lock type")
+
+var leaderLockFactories = map[string]func(config Config) (LeaderLock,
+	error){
+	"file": newFileLock,
+}
+
+const leaderCheckInterval = time.Second * 5
+
+var leaderLock LeaderLock
+var leaderMutex = &sync.Mutex{}
+var leader = true
+
+// isLeader returns whether this reverse proxy is the leader. Without leader
+// election, it always is.
+func isLeader() bool {
+	leaderMutex.Lock()
+	defer leaderMutex.Unlock()
+	return leader
+}
+
+func loadLeaderLock(config Config) {
+	if config.LeaderElection.Lock == "" {
+		return
+	}
+
+	factory, found := leaderLockFactories[config.LeaderElection.Lock]
+	if !found {
+		Fatal("leader", "Failed to load lock \""+
+			config.LeaderElection.Lock+"\":", errUnknownLock)
+	}
+
+	lock, err := factory(config)
+	if err != nil {
+		Fatal("leader", "Failed to load lock:", err)
+	}
+
+	leaderLock = lock
+	electLeader()
+}
+
+// electLeader tries to take or keep the lock, and updates whether this
+// reverse proxy is the leader.
+func electLeader() {
+	acquired, err := leaderLock.TryAcquire()
+	if err != nil {
+		Warn("leader", "Failed to acquire leader lock:", err)
+		acquired = false
+	}
+
+	leaderMutex.Lock()
+	changed := acquired != leader
+	leader = acquired
+	leaderMutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if acquired {
+		Log("leader", "This reverse proxy is now the leader.")
+		resumeFromJournal()
+	} else {
+		Log("leader", "This reverse proxy is now on standby.")
+	}
+}
+
+func startLeaderElection() {
+	if leaderLock == nil {
+		return
+	}
+
+	for {
+		time.Sleep(leaderCheckInterval)
+		electLeader()
+	}
+}
+
+// requireLeader returns whether the action may run, logging it if not.
+func (s *Server) requireLeader(action string) bool {
+	if isLeader() {
+		return true
+	}
+
+	s.Log(action, "Not running "+action+", this reverse proxy is on "+
+		"standby.")
+	return false
+}
+
+// fileLock is a LeaderLock on a file, which must be on a file system shared
+// by the reverse proxies that supports flock, such as a local disk. The lock
+// is released by the operating system if the reverse proxy dies.
+type fileLock struct {
+	path string
+	file *os.File
+}
+
+func newFileLock(config Config) (LeaderLock, error) {
+	path := config.LeaderElection.Path
+	if path == "" {
+		path = "leader.lock"
+	}
+
+	if !filepath.IsAbs(path) {
+		dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+		if err != nil {
+			return nil, err
+		}
+
+		path = filepath.Join(dir, path)
+	}
+
+	return &fileLock{path: path}, nil
+}
+
+func (l *fileLock) TryAcquire() (bool, error) {
+	if l.file != nil {
+		// The lock is lost if the file was removed or replaced.
+		held, err := l.file.Stat()
+		current, statErr := os.Stat(l.path)
+		if err == nil && statErr == nil && os.SameFile(held, current) {
+			return true, nil
+		}
+
+		l.file.Close()
+		l.file = nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return false, nil
+	} else if err != nil {
+		file.Close()
+		return false, err
+	}
+
+	// Record who holds the lock, for anyone looking.
+	hostname, _ := os.Hostname()
+	file.Truncate(0)
+	file.WriteAt([]byte(hostname+" "+strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	l.file = file
+	return true, nil
+}
+
+func (l *fileLock) Release() error {
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -1,20 +1,156 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"github.com/1lann/dynamicserver/logging"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Logs are leveled and structured, and written as text or JSON according to
+// the logging section of the configuration. With logging.directory set, each
+// server also logs to its own rotating file in that directory.
+
+const maxRecentLogs = 200
+
+type logEntry struct {
+	Time    time.Time     `json:"time"`
+	Level   logging.Level `json:"level"`
+	Server  string        `json:"server,omitempty"`
+	Module  string        `json:"module"`
+	Message string        `json:"message"`
+}
+
+var logger = logging.New()
+
+var recentLogsLock = &sync.Mutex{}
+var recentLogs []logEntry
+
+// configureLogging applies the logging level and format.
+func configureLogging(config Config) {
+	if err := logger.Configure(config.Logging); err != nil {
+		Warn("config", "Invalid logging configuration:", err)
+	}
+}
+
+// openLogFile returns the server's log file, or nil if log files are
+// disabled.
+func openLogFile(config Config, name string) *logging.RotatingWriter {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		Fatal("config", "Could not resolve filepath:", err)
+	}
+
+	return config.Logging.File(dir, name)
+}
+
+func (s *Server) writeLog(level logging.Level, module string,
+	message []interface{}) {
+	entry := logging.Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Server:  s.Name,
+		Module:  module,
+		State:   s.State.String(),
+		Message: formatMessage(message),
+	}
+
+	// A nil *RotatingWriter isn't a nil io.Writer.
+	if s.logFile != nil {
+		logger.Write(entry, s.logFile)
+	} else {
+		logger.Write(entry, nil)
+	}
+
+	recordLog(entry)
+}
+
+func (s *Server) Debug(module string, message ...interface{}) {
+	s.writeLog(logging.LevelDebug, module, message)
+}
+
 func (s *Server) Log(module string, message ...interface{}) {
-	log.Println(append([]interface{}{s.Name + " | " + module + " |"},
-		message...)...)
+	s.writeLog(logging.LevelInfo, module, message)
+}
+
+func (s *Server) Warn(module string, message ...interface{}) {
+	s.writeLog(logging.LevelWarn, module, message)
+}
+
+func (s *Server) Error(module string, message ...interface{}) {
+	s.writeLog(logging.LevelError, module, message)
+}
+
+func writeLog(level logging.Level, module string, message []interface{}) {
+	entry := logging.Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Server:  "general",
+		Module:  module,
+		Message: formatMessage(message),
+	}
+
+	logger.Write(entry, nil)
+
+	entry.Server = ""
+	recordLog(entry)
+}
+
+func Debug(module string, message ...interface{}) {
+	writeLog(logging.LevelDebug, module, message)
 }
 
 func Log(module string, message ...interface{}) {
-	log.Println(append([]interface{}{"general | " + module + " |"},
-		message...)...)
+	writeLog(logging.LevelInfo, module, message)
+}
+
+func Warn(module string, message ...interface{}) {
+	writeLog(logging.LevelWarn, module, message)
+}
+
+func Error(module string, message ...interface{}) {
+	writeLog(logging.LevelError, module, message)
 }
 
 func Fatal(module string, message ...interface{}) {
-	log.Fatal(append([]interface{}{"general | " + module + " | "},
-		message...)...)
+	writeLog(logging.LevelError, module, message)
+	os.Exit(1)
+}
+
+func formatMessage(message []interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(message...), "\n")
+}
+
+// recordLog keeps the log entry for the dashboard.
+func recordLog(entry logging.Entry) {
+	if entry.Level == logging.LevelDebug {
+		return
+	}
+
+	recent := logEntry{
+		Time:    entry.Time,
+		Level:   entry.Level,
+		Server:  entry.Server,
+		Module:  entry.Module,
+		Message: entry.Message,
+	}
+
+	recentLogsLock.Lock()
+	recentLogs = append(recentLogs, recent)
+	if len(recentLogs) > maxRecentLogs {
+		recentLogs = recentLogs[len(recentLogs)-maxRecentLogs:]
+	}
+	recentLogsLock.Unlock()
+
+	publishEvent("log", recent)
+}
+
+// getRecentLogs returns the most recent log lines, oldest first.
+func getRecentLogs() []logEntry {
+	recentLogsLock.Lock()
+	defer recentLogsLock.Unlock()
+	return append([]logEntry{}, recentLogs...)
 }
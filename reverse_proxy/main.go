@@ -3,11 +3,14 @@ package main
 import (
 	"github.com/1lann/beacon/handler"
 	"github.com/1lann/beacon/ping"
+	"github.com/1lann/dynamicserver/control"
+	"github.com/1lann/dynamicserver/logging"
+	"os"
 	"sync"
 	"time"
 )
 
-const version = "0.1"
+const version = "0.2"
 
 type Server struct {
 	ConfigServer
@@ -16,11 +19,28 @@ type Server struct {
 	PingStatus         ping.Status
 	ConnectMessage     string
 	StateLock          *sync.Mutex
+	transitionLock     sync.Mutex
+	transitions        []stateTransition
 	DropletId          int
+	DropletCreated     time.Time
+	Provider           Provider
 	LastConnectionTime time.Time
 	ShutdownDeadline   time.Time
+	Operation          string
+	OperationStarted   time.Time
 	NumConnections     int
+	ProtocolVersion    int
+	Heartbeat          control.HeartbeatData
+	LastHeartbeat      time.Time
+	CrashReport        string
+	Progress           control.ProgressData
+	StartupPhase       string
+	Maintenance        bool
+	configAvailable    bool
 	notifyStopped      bool
+	auth               *control.Authenticator
+	boot               *bootTimer
+	logFile            *logging.RotatingWriter
 	notifyChannel      chan interface{}
 }
 
@@ -28,11 +48,45 @@ var globalConfig Config
 var allServers []*Server
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "issue-cert":
+			if len(os.Args) != 3 {
+				Fatal("main", "Usage: reverse_proxy issue-cert <name>")
+			}
+
+			issueCertCommand(os.Args[2])
+			return
+		}
+	}
+
 	config := loadConfig()
+	configureLogging(config)
+
+	onStateTransition(logStateTransition)
+	onStateTransition(journalStateHook)
+	onStateTransition(resetHeartbeatHook)
+	onStateTransition(resetProgressHook)
+	onStateTransition(bootTimingHook)
+	onStateTransition(dashboardTransitionHook)
+	onStateTransition(metricsStateHook)
+	onStateTransition(webhookStateHook)
+	onStateTransition(startUsageHook)
 
 	// Intialize the servers
 	for _, server := range config.Servers {
-		newServer := &Server{ConfigServer: server, StateLock: &sync.Mutex{}}
+		newServer := &Server{
+			ConfigServer:    server,
+			StateLock:       &sync.Mutex{},
+			configAvailable: server.Available,
+			logFile:         openLogFile(config, server.Name),
+			auth:            control.NewAuthenticator(server.ControlSecret),
+		}
+
+		if server.ControlSecret == "" {
+			newServer.Warn("main", "No control_secret is set, "+
+				"the control channel is unauthenticated.")
+		}
 
 		newServer.PingStatus = ping.Status{
 			MaxPlayers:     server.MaxPlayers,
@@ -52,9 +106,34 @@ func main() {
 
 	globalConfig.CommunicationsPort = config.CommunicationsPort
 	globalConfig.APIToken = config.APIToken
+	globalConfig.CertificateDirectory = config.CertificateDirectory
+	globalConfig.Logging = config.Logging
+	setGlobalWebhooks(config.Webhooks)
+
+	for _, server := range config.Servers {
+		if server.ControlTLS {
+			err := loadCertificateAuthority(config)
+			if err != nil {
+				Fatal("main", "Failed to load control channel "+
+					"certificates:", err)
+			}
+
+			break
+		}
+	}
 
 	watchConfig()
-	loadDoClient()
+	loadProviders()
+	loadLeaderLock(config)
+	loadJournalPath(config)
+	loadBootTimes(config)
+	loadStartUsage(config)
+
+	// Operations are only resumed by the leader. A standby reverse proxy
+	// resumes them once it takes over.
+	if isLeader() {
+		resumeFromJournal()
+	}
 
 	handler.OnForwardConnect = trackForwardConnect
 	handler.OnForwardDisconnect = trackForwardDisconnect
@@ -63,6 +142,8 @@ func main() {
 	go startDropletMonitor()
 	go startConnectionMonitor()
 	go startResponseMonitor()
+	go startLeaderElection()
+	go startAdminAPI(config)
 
 	Log("main", "Initialized dynamicserver reverse proxy v"+version+".")
 	startComm()
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are served at /metrics on the admin API in the Prometheus text
+// format. Counters and histograms are recorded as things happen, and the
+// state of each server is read when scraped.
+
+type metricInfo struct {
+	kind string
+	help string
+}
+
+var metricInfos = map[string]metricInfo{
+	"dynamicserver_server_state": {"gauge",
+		"Whether the server is in the state, 1 for the current state."},
+	"dynamicserver_server_state_seconds": {"gauge",
+		"How long the server has been in its current state."},
+	"dynamicserver_server_available": {"gauge",
+		"Whether the server is available to players."},
+	"dynamicserver_server_maintenance": {"gauge",
+		"Whether the server is in maintenance mode."},
+	"dynamicserver_connections": {"gauge",
+		"Number of connections forwarded to the server."},
+	"dynamicserver_online_players": {"gauge",
+		"Number of players online as reported by the back end."},
+	"dynamicserver_droplet_uptime_seconds": {"gauge",
+		"How long ago the server's droplet was created."},
+	"dynamicserver_ping_latency_seconds": {"gauge",
+		"Latency of the most recent status ping of the server."},
+	"dynamicserver_pings_total": {"counter",
+		"Status pings of the server, by result."},
+	"dynamicserver_action_duration_seconds": {"histogram",
+		"How long restores, snapshots and destroys took to complete."},
+	"dynamicserver_action_failures_total": {"counter",
+		"Restores, snapshots and destroys which failed."},
+	"dynamicserver_provider_requests_total": {"counter",
+		"Requests made to the provider's API, by method."},
+	"dynamicserver_provider_errors_total": {"counter",
+		"Requests to the provider's API which failed, by method."},
+	"dynamicserver_control_messages_total": {"counter",
+		"Control channel messages received from back ends, by type."},
+}
+
+var actionDurationBuckets = []float64{10, 30, 60, 120, 180, 300, 600, 900,
+	1800, 3600}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// metricSeries identifies a series by its name and formatted labels.
+type metricSeries struct {
+	name   string
+	labels string
+}
+
+var metricsLock = &sync.Mutex{}
+var counters = make(map[metricSeries]float64)
+var histograms = make(map[metricSeries]*histogram)
+var pingLatencies = make(map[string]time.Duration)
+
+// startTime is used as when servers entered their state before any
+// transition is recorded.
+var startTime = time.Now()
+
+// formatLabels formats label names and values given in pairs.
+func formatLabels(labels ...string) string {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).
+			Replace(labels[i+1])
+		pairs = append(pairs, labels[i]+`="`+value+`"`)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func incrementCounter(name string, labels ...string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	counters[metricSeries{name, formatLabels(labels...)}]++
+}
+
+func observeHistogram(name string, buckets []float64, value float64,
+	labels ...string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	series := metricSeries{name, formatLabels(labels...)}
+	h, found := histograms[series]
+	if !found {
+		h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		histograms[series] = h
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += value
+	h.count++
+}
+
+// observeAction records how long a restore, snapshot or destroy took.
+func (s *Server) observeAction(action string, duration time.Duration) {
+	observeHistogram("dynamicserver_action_duration_seconds",
+		actionDurationBuckets, duration.Seconds(), "server", s.Name,
+		"action", action)
+}
+
+// countActionFailure records a failed restore, snapshot or destroy, and
+// notifies webhooks of it.
+func (s *Server) countActionFailure(action string) {
+	incrementCounter("dynamicserver_action_failures_total", "server", s.Name,
+		"action", action)
+	s.notifyWebhooks(webhookActionFailed, "The "+action+" failed.",
+		map[string]interface{}{"action": action})
+}
+
+func (s *Server) observePing(latency time.Duration, responding bool) {
+	result := "failed"
+	if responding {
+		result = "ok"
+	}
+
+	incrementCounter("dynamicserver_pings_total", "server", s.Name,
+		"result", result)
+
+	if responding {
+		metricsLock.Lock()
+		pingLatencies[s.Name] = latency
+		metricsLock.Unlock()
+	}
+}
+
+// stateSince returns when the server entered its current state.
+func (s *Server) stateSince() time.Time {
+	transitions := s.TransitionHistory()
+	if len(transitions) == 0 {
+		return startTime
+	}
+
+	return transitions[len(transitions)-1].Time
+}
+
+// metricsStateHook records how long destroys took, which is until the
+// droplet is gone.
+func metricsStateHook(s *Server, from state, to state) {
+	if from != stateDestroy || to != stateOff {
+		return
+	}
+
+	transitions := s.TransitionHistory()
+	if len(transitions) < 2 {
+		return
+	}
+
+	s.observeAction("destroy", transitions[len(transitions)-1].Time.Sub(
+		transitions[len(transitions)-2].Time))
+}
+
+type metricsWriter struct {
+	lines map[string][]string
+}
+
+func (w *metricsWriter) add(name string, labels string, value float64) {
+	w.addSample(name, name, labels, value)
+}
+
+// addSample adds a sample to a metric, such as the _sum of a histogram.
+func (w *metricsWriter) addSample(metric string, name string, labels string,
+	value float64) {
+	line := name
+	if labels != "" {
+		line += "{" + labels + "}"
+	}
+
+	w.lines[metric] = append(w.lines[metric], line+" "+
+		strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	out := &metricsWriter{lines: make(map[string][]string)}
+
+	for _, server := range allServers {
+		labels := formatLabels("server", server.Name)
+
+		for st := stateInitializing; st <= stateCrashed; st++ {
+			out.add("dynamicserver_server_state", formatLabels("server",
+				server.Name, "state", st.String()),
+				boolValue(server.State == st))
+		}
+
+		out.add("dynamicserver_server_state_seconds", labels,
+			time.Now().Sub(server.stateSince()).Seconds())
+		out.add("dynamicserver_server_available", labels,
+			boolValue(server.Available))
+		out.add("dynamicserver_server_maintenance", labels,
+			boolValue(server.Maintenance))
+		out.add("dynamicserver_connections", labels,
+			float64(server.NumConnections))
+
+		if players := server.onlinePlayers(); players >= 0 {
+			out.add("dynamicserver_online_players", labels, float64(players))
+		}
+
+		if !server.DropletCreated.IsZero() {
+			out.add("dynamicserver_droplet_uptime_seconds", labels,
+				time.Now().Sub(server.DropletCreated).Seconds())
+		}
+	}
+
+	metricsLock.Lock()
+
+	for _, server := range allServers {
+		if latency, found := pingLatencies[server.Name]; found {
+			out.add("dynamicserver_ping_latency_seconds",
+				formatLabels("server", server.Name), latency.Seconds())
+		}
+	}
+
+	for _, series := range sortedSeries(counters, nil) {
+		out.add(series.name, series.labels, counters[series])
+	}
+
+	for _, series := range sortedSeries(nil, histograms) {
+		h := histograms[series]
+		prefix := series.labels
+		if prefix != "" {
+			prefix += ","
+		}
+
+		for i, bound := range h.buckets {
+			out.addSample(series.name, series.name+"_bucket",
+				prefix+formatLabels("le", strconv.FormatFloat(bound, 'g', -1,
+					64)), float64(h.counts[i]))
+		}
+
+		out.addSample(series.name, series.name+"_bucket",
+			prefix+`le="+Inf"`, float64(h.count))
+		out.addSample(series.name, series.name+"_sum", series.labels, h.sum)
+		out.addSample(series.name, series.name+"_count", series.labels,
+			float64(h.count))
+	}
+
+	metricsLock.Unlock()
+
+	var names []string
+	for name := range metricInfos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, name := range names {
+		info := metricInfos[name]
+		lines := out.lines[name]
+		if len(lines) == 0 {
+			continue
+		}
+
+		w.Write([]byte("# HELP " + name + " " + info.help + "\n" +
+			"# TYPE " + name + " " + info.kind + "\n" +
+			strings.Join(lines, "\n") + "\n"))
+	}
+}
+
+// sortedSeries returns the series of counters or histograms in order, so that
+// scrapes are stable.
+func sortedSeries(counters map[metricSeries]float64,
+	histograms map[metricSeries]*histogram) []metricSeries {
+	var series []metricSeries
+	for s := range counters {
+		series = append(series, s)
+	}
+	for s := range histograms {
+		series = append(series, s)
+	}
+
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+
+		return series[i].labels < series[j].labels
+	})
+
+	return series
+}
+
+// instrumentedProvider counts the requests made to a provider and their
+// errors.
+type instrumentedProvider struct {
+	name     string
+	provider Provider
+}
+
+func (p *instrumentedProvider) count(method string, err error) {
+	incrementCounter("dynamicserver_provider_requests_total",
+		"provider", p.name, "method", method)
+	if err != nil {
+		incrementCounter("dynamicserver_provider_errors_total",
+			"provider", p.name, "method", method)
+	}
+}
+
+func (p *instrumentedProvider) ListMachines() ([]Machine, error) {
+	machines, err := p.provider.ListMachines()
+	p.count("list_machines", err)
+	return machines, err
+}
+
+func (p *instrumentedProvider) CreateMachine(req CreateRequest) error {
+	err := p.provider.CreateMachine(req)
+	p.count("create_machine", err)
+	return err
+}
+
+func (p *instrumentedProvider) DeleteMachine(machineID int) error {
+	err := p.provider.DeleteMachine(machineID)
+	p.count("delete_machine", err)
+	return err
+}
+
+func (p *instrumentedProvider) PowerOff(machineID int) error {
+	err := p.provider.PowerOff(machineID)
+	p.count("power_off", err)
+	return err
+}
+
+func (p *instrumentedProvider) Snapshot(machineID int, name string) error {
+	err := p.provider.Snapshot(machineID, name)
+	p.count("snapshot", err)
+	return err
+}
+
+func (p *instrumentedProvider) ListImages() ([]Image, error) {
+	images, err := p.provider.ListImages()
+	p.count("list_images", err)
+	return images, err
+}
+
+func (p *instrumentedProvider) DeleteImage(imageID int) error {
+	err := p.provider.DeleteImage(imageID)
+	p.count("delete_image", err)
+	return err
+}
+
+func (p *instrumentedProvider) ListActions(machineID int) ([]Action, error) {
+	actions, err := p.provider.ListActions(machineID)
+	p.count("list_actions", err)
+	return actions, err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/1lann/beacon/chat"
+	"github.com/1lann/dynamicserver/control"
+	"strconv"
+)
+
+// Startup phases shown in the server list while a server is starting, from
+// the droplet's progress. Progress reported by the backend takes over once
+// Minecraft is starting.
+const (
+	phaseCreatingDroplet = "Creating droplet"
+	phaseBootingOS       = "Booting OS"
+	phaseStartingJava    = "Starting Java"
+	phaseLoadingWorld    = "Loading world"
+	phaseRestarting      = "Restarting after a crash"
+)
+
+// startupPhase returns the current startup phase to show players, or an
+// empty string if it isn't known.
+func (s *Server) startupPhase() string {
+	switch s.Progress.Phase {
+	case control.PhaseStarting:
+		return phaseStartingJava
+	case control.PhasePreparingLevel:
+		return phaseLoadingWorld
+	case control.PhasePreparingSpawn:
+		return phaseLoadingWorld + " " + strconv.Itoa(s.Progress.Percent) +
+			"%"
+	case control.PhaseReady:
+		return phaseLoadingWorld + " 100%"
+	}
+
+	return s.StartupPhase
+}
+
+// setStartupPhase sets the startup phase from the droplet's progress. It is
+// ignored once the backend reports progress of its own.
+func (s *Server) setStartupPhase(phase string) {
+	if phase != s.StartupPhase && s.Progress.Phase == "" {
+		s.Log("progress", "Startup phase:", phase)
+	}
+
+	s.StartupPhase = phase
+
+	switch phase {
+	case phaseBootingOS:
+		s.advanceBootPhase(bootPhaseBackend)
+	case phaseStartingJava:
+		s.advanceBootPhase(bootPhaseMinecraft)
+	}
+
+	s.updateStartingMessage()
+}
+
+// updateStartingMessage shows the startup phase and the estimated time left
+// in the server list and to players connecting.
+func (s *Server) updateStartingMessage() {
+	if s.State != stateStarting {
+		return
+	}
+
+	message := chat.Format(s.Messages.ServerInfoPrefix) + chat.LightGreen +
+		"Starting up..."
+	if phase := s.startupPhase(); phase != "" {
+		message += " " + chat.Gray + phase
+	}
+
+	s.ConnectMessage = "Sorry, the server is still starting up.\n"
+
+	if left, ok := s.bootTimeLeft(); ok && left > 0 {
+		message += chat.Gray + " (about " + formatBootTime(left) + " left)"
+		s.ConnectMessage += "Try connecting again in about " +
+			formatBootTime(left) + "."
+	} else if ok {
+		message += chat.Gray + " (almost ready)"
+		s.ConnectMessage += "It should be ready any moment now."
+	} else {
+		s.ConnectMessage += "Try connecting again in a few minutes."
+	}
+
+	s.PingStatus.Message = message
+}
+
+// receiveProgress records the startup phase reported by the backend. Once
+// the backend reports the Minecraft server ready, the server is marked as
+// started without waiting for the next check.
+func (s *Server) receiveProgress(progress control.ProgressData) {
+	if progress.Phase != s.Progress.Phase {
+		if progress.Phase == control.PhaseReady {
+			s.Log("progress", "Minecraft server ready after",
+				progress.Seconds, "seconds.")
+		} else {
+			s.Log("progress", "Minecraft server startup phase:",
+				progress.Phase)
+		}
+	}
+
+	s.Progress = progress
+	s.advanceBootPhase(bootPhaseMinecraft)
+	s.updateStartingMessage()
+
+	if progress.Phase == control.PhaseReady && s.State == stateStarting &&
+		!s.heartbeatStale() && s.IsMinecraftServerResponding() {
+		s.SetState(stateStarted)
+	}
+}
+
+// resetProgressHook forgets the startup progress of previous runs.
+func resetProgressHook(s *Server, from state, to state) {
+	if to == stateOff || to == stateStarting {
+		s.Progress = control.ProgressData{}
+		s.StartupPhase = ""
+		s.updateStartingMessage()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Machine is a virtual machine as reported by a provider.
+type Machine struct {
+	ID        int
+	Name      string
+	Status    string
+	IPAddress string
+	Created   time.Time
+}
+
+// Image is a user owned image (snapshot) as reported by a provider.
+type Image struct {
+	ID   int
+	Name string
+}
+
+// Action is an action performed on a machine, such as a create or snapshot.
+type Action struct {
+	ID        int
+	Type      string
+	Status    string
+	StartedAt time.Time
+}
+
+// CreateRequest describes a machine to be created from an image.
+type CreateRequest struct {
+	Name           string
+	Region         string
+	Size           string
+	SSHFingerprint string
+	ImageID        int
+}
+
+// Provider is a cloud host that can run, snapshot and restore servers.
+// Machine statuses and action types and statuses use DigitalOcean's
+// vocabulary ("active", "off", "create", "snapshot", "completed", etc.),
+// other providers are expected to map their own onto it.
+type Provider interface {
+	ListMachines() ([]Machine, error)
+	CreateMachine(req CreateRequest) error
+	DeleteMachine(machineID int) error
+	PowerOff(machineID int) error
+	Snapshot(machineID int, name string) error
+	ListImages() ([]Image, error)
+	DeleteImage(imageID int) error
+	// ListActions returns the actions of a machine, most recent first.
+	ListActions(machineID int) ([]Action, error)
+}
+
+const defaultProvider = "digitalocean"
+
+var errUnknownProvider = errors.New("provider: unknown provider")
+
+var providerFactories = map[string]func(config Config) (Provider, error){
+	"digitalocean": newDigitalOceanProvider,
+}
+
+var loadedProviders = make(map[string]Provider)
+
+func getProvider(name string) (Provider, error) {
+	if name == "" {
+		name = defaultProvider
+	}
+
+	if provider, found := loadedProviders[name]; found {
+		return provider, nil
+	}
+
+	factory, found := providerFactories[name]
+	if !found {
+		return nil, errUnknownProvider
+	}
+
+	provider, err := factory(globalConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	provider = &instrumentedProvider{name: name, provider: provider}
+	loadedProviders[name] = provider
+	return provider, nil
+}
+
+func loadProviders() {
+	for _, server := range allServers {
+		provider, err := getProvider(server.ProviderName)
+		if err != nil {
+			Fatal("provider", "Failed to load provider \""+
+				server.ProviderName+"\" for "+server.Name+":", err)
+		}
+
+		server.Provider = provider
+	}
+}
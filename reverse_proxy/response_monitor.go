@@ -6,8 +6,17 @@ import (
 	"time"
 )
 
-func (s *Server) IsMinecraftServerResponding() bool {
-	conn, err := net.DialTimeout("tcp", s.IPAddress+":25565", time.Second*5)
+// minecraftPort is the port Minecraft servers listen on, which tests change.
+var minecraftPort = "25565"
+
+func (s *Server) IsMinecraftServerResponding() (responding bool) {
+	started := time.Now()
+	defer func() {
+		s.observePing(time.Now().Sub(started), responding)
+	}()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(s.IPAddress,
+		minecraftPort), time.Second*5)
 	if err != nil {
 		return false
 	}
@@ -55,9 +64,8 @@ func startResponseMonitor() {
 			server.StateLock.Lock()
 
 			if server.IsMinecraftServerResponding() {
-				if server.State != stateShutdown &&
-					server.State != stateSnapshot &&
-					server.State != stateDestroy {
+				if server.CanTransition(stateStarted) &&
+					!server.heartbeatStale() {
 					server.SetState(stateStarted)
 				}
 			} else {
@@ -66,6 +74,11 @@ func startResponseMonitor() {
 				}
 			}
 
+			checkHeartbeat(server)
+
+			// Keep the estimated time left up to date.
+			server.updateStartingMessage()
+
 			server.StateLock.Unlock()
 		}
 
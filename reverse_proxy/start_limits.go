@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Start limits stop players from starting servers too often. Each server can
+// limit how many times a player, and anyone at all, may start it a day, how
+// long it must stay off after shutting down, and how many hours of droplet
+// time each player's starts may use a day. Days are the last 24 hours. Usage
+// is recorded on disk so that it survives restarts.
+
+const startLimitWindow = time.Hour * 24
+
+type StartLimits struct {
+	PlayerStartsPerDay       int     `json:"player_starts_per_day"`
+	ServerStartsPerDay       int     `json:"server_starts_per_day"`
+	CooldownMinutes          int     `json:"cooldown_minutes"`
+	PlayerDropletHoursPerDay float64 `json:"player_droplet_hours_per_day"`
+}
+
+// startRecord is a start of a server, and how long its droplet ran for.
+type startRecord struct {
+	Server string `json:"server"`
+	// Player is empty for starts through the admin API, which count towards
+	// the server's starts but aren't limited.
+	Player  string    `json:"player"`
+	Started time.Time `json:"started"`
+	// Stopped is zero while the droplet is running.
+	Stopped time.Time `json:"stopped"`
+}
+
+type startUsage struct {
+	Starts []startRecord `json:"starts"`
+	// Shutdowns is when each server last finished shutting down.
+	Shutdowns map[string]time.Time `json:"shutdowns"`
+}
+
+var startUsageLock = &sync.Mutex{}
+
+// startUsagePath is empty if usage isn't kept on disk, such as in tests.
+var startUsagePath string
+
+var usage = startUsage{Shutdowns: make(map[string]time.Time)}
+
+func loadStartUsage(config Config) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		Fatal("start limits", "Could not resolve filepath:", err)
+	}
+
+	startUsagePath = config.StartUsage
+	if startUsagePath == "" {
+		startUsagePath = "start_usage.json"
+	}
+
+	if !filepath.IsAbs(startUsagePath) {
+		startUsagePath = filepath.Join(dir, startUsagePath)
+	}
+
+	data, err := ioutil.ReadFile(startUsagePath)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		Warn("start limits", "Failed to read start usage, ignoring it:", err)
+		return
+	}
+
+	startUsageLock.Lock()
+	defer startUsageLock.Unlock()
+
+	if err := json.Unmarshal(data, &usage); err != nil {
+		Warn("start limits", "Failed to decode start usage, ignoring it:",
+			err)
+		usage = startUsage{}
+	}
+
+	if usage.Shutdowns == nil {
+		usage.Shutdowns = make(map[string]time.Time)
+	}
+}
+
+// writeStartUsage forgets usage older than a day, and writes the usage to
+// disk. startUsageLock must be held.
+func writeStartUsage() {
+	since := time.Now().Add(-startLimitWindow)
+
+	var starts []startRecord
+	for _, record := range usage.Starts {
+		if record.Stopped.IsZero() || record.Stopped.After(since) {
+			starts = append(starts, record)
+		}
+	}
+	usage.Starts = starts
+
+	if startUsagePath == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(usage, "", "\t")
+	if err != nil {
+		Warn("start limits", "Failed to encode start usage:", err)
+		return
+	}
+
+	err = ioutil.WriteFile(startUsagePath+".tmp", data, 0600)
+	if err != nil {
+		Warn("start limits", "Failed to write start usage:", err)
+		return
+	}
+
+	err = os.Rename(startUsagePath+".tmp", startUsagePath)
+	if err != nil {
+		Warn("start limits", "Failed to replace start usage:", err)
+	}
+}
+
+// recordStart records a start through the admin API, which isn't limited.
+func (s *Server) recordStart() {
+	startUsageLock.Lock()
+	defer startUsageLock.Unlock()
+	s.addStart("")
+}
+
+// checkAndRecordStart returns why the player may not start the server, or
+// records the start and returns an empty string if they may. Checking and
+// recording happen together so that players starting the server at the same
+// time can't both get in under a limit.
+func (s *Server) checkAndRecordStart(player string) string {
+	startUsageLock.Lock()
+	defer startUsageLock.Unlock()
+
+	if reason := s.startLimitReason(player); reason != "" {
+		return reason
+	}
+
+	s.addStart(player)
+	return ""
+}
+
+// addStart records that the player started the server. startUsageLock must
+// be held.
+func (s *Server) addStart(player string) {
+	usage.Starts = append(usage.Starts, startRecord{
+		Server:  s.Name,
+		Player:  player,
+		Started: time.Now(),
+	})
+	writeStartUsage()
+}
+
+// startUsageHook records when droplets stop running.
+func startUsageHook(s *Server, from state, to state) {
+	if to != stateOff {
+		return
+	}
+
+	startUsageLock.Lock()
+	defer startUsageLock.Unlock()
+
+	for i, record := range usage.Starts {
+		if record.Server == s.Name && record.Stopped.IsZero() {
+			usage.Starts[i].Stopped = time.Now()
+		}
+	}
+
+	// Finding the server off when we start isn't a shutdown, and neither is
+	// a start which failed.
+	if from != stateInitializing && from != stateStarting {
+		usage.Shutdowns[s.Name] = time.Now()
+	}
+
+	writeStartUsage()
+}
+
+// startLimitReason returns why the player may not start the server, or an
+// empty string if they may. startUsageLock must be held.
+func (s *Server) startLimitReason(player string) string {
+	limits := s.StartLimits
+	now := time.Now()
+	since := now.Add(-startLimitWindow)
+
+	if limits.CooldownMinutes > 0 {
+		ready := usage.Shutdowns[s.Name].Add(time.Duration(
+			limits.CooldownMinutes) * time.Minute)
+		if now.Before(ready) {
+			return "Sorry, the server has only just shut down.\n" +
+				"You can start it again in " + formatWait(ready.Sub(now)) +
+				"."
+		}
+	}
+
+	var serverStarts, playerStarts []time.Time
+	var playerRecords []startRecord
+	for _, record := range usage.Starts {
+		if record.Server != s.Name {
+			continue
+		}
+
+		if record.Started.After(since) {
+			serverStarts = append(serverStarts, record.Started)
+		}
+
+		if strings.EqualFold(record.Player, player) {
+			playerRecords = append(playerRecords, record)
+			if record.Started.After(since) {
+				playerStarts = append(playerStarts, record.Started)
+			}
+		}
+	}
+
+	if limits.ServerStartsPerDay > 0 &&
+		len(serverStarts) >= limits.ServerStartsPerDay {
+		return "Sorry, the server has already been started " +
+			formatTimes(limits.ServerStartsPerDay) + " today.\n" +
+			"It can be started again in " + formatWait(startsWait(
+			serverStarts, limits.ServerStartsPerDay)) + "."
+	}
+
+	if limits.PlayerStartsPerDay > 0 &&
+		len(playerStarts) >= limits.PlayerStartsPerDay {
+		return "Sorry, you have already started the server " +
+			formatTimes(limits.PlayerStartsPerDay) + " today.\n" +
+			"You can start it again in " + formatWait(startsWait(
+			playerStarts, limits.PlayerStartsPerDay)) + "."
+	}
+
+	if limits.PlayerDropletHoursPerDay > 0 {
+		allowance := time.Duration(limits.PlayerDropletHoursPerDay *
+			float64(time.Hour))
+		if dropletTime(playerRecords, now) >= allowance {
+			return "Sorry, you have used up your " +
+				formatWait(allowance) + " of server time for today.\n" +
+				"You can start the server again in " + formatWait(
+				dropletTimeWait(playerRecords, allowance, now)) + "."
+		}
+	}
+
+	return ""
+}
+
+// startsWait returns how long until there are fewer than limit starts in
+// the last day. starts are oldest first.
+func startsWait(starts []time.Time, limit int) time.Duration {
+	return starts[len(starts)-limit].Add(startLimitWindow).Sub(time.Now())
+}
+
+// dropletTime returns how long the droplets started by the records ran for
+// in the day before the given time.
+func dropletTime(records []startRecord, at time.Time) time.Duration {
+	since := at.Add(-startLimitWindow)
+
+	var total time.Duration
+	for _, record := range records {
+		started, stopped := record.Started, record.Stopped
+		if stopped.IsZero() || stopped.After(at) {
+			stopped = at
+		}
+		if started.Before(since) {
+			started = since
+		}
+
+		if stopped.After(started) {
+			total += stopped.Sub(started)
+		}
+	}
+
+	return total
+}
+
+// dropletTimeWait returns how long until the droplet time used in the last
+// day is under the allowance, to the nearest 5 minutes.
+func dropletTimeWait(records []startRecord, allowance time.Duration,
+	now time.Time) time.Duration {
+	step := time.Minute * 5
+	for wait := step; wait < startLimitWindow; wait += step {
+		if dropletTime(records, now.Add(wait)) < allowance {
+			return wait
+		}
+	}
+
+	return startLimitWindow
+}
+
+func formatTimes(n int) string {
+	switch n {
+	case 1:
+		return "once"
+	case 2:
+		return "twice"
+	}
+
+	return strconv.Itoa(n) + " times"
+}
+
+// formatWait formats a duration for players, such as "3 hours".
+func formatWait(d time.Duration) string {
+	if d < time.Hour-time.Second*30 {
+		return formatBootTime(d)
+	}
+
+	hours := int((d + time.Minute*30) / time.Hour)
+	if hours == 1 {
+		return "1 hour"
+	}
+
+	return strconv.Itoa(hours) + " hours"
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func resetStartUsage() {
+	startUsageLock.Lock()
+	defer startUsageLock.Unlock()
+	usage = startUsage{Shutdowns: make(map[string]time.Time)}
+}
+
+func ago(d time.Duration) time.Time {
+	return time.Now().Add(-d)
+}
+
+func TestCheckAndRecordStart(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits StartLimits
+		starts []startRecord
+		// shutdown is how long ago the server shut down, if it has.
+		shutdown time.Duration
+		player   string
+		// reason is part of the expected reason, or empty if the start is
+		// allowed.
+		reason string
+	}{
+		{
+			name: "no limits",
+			starts: []startRecord{
+				{Server: "test", Player: "alice", Started: ago(time.Hour)},
+				{Server: "test", Player: "alice", Started: ago(time.Minute)},
+			},
+			shutdown: time.Second,
+			player:   "alice",
+		},
+		{
+			name:     "cooling down",
+			limits:   StartLimits{CooldownMinutes: 30},
+			shutdown: time.Minute * 10,
+			player:   "alice",
+			reason:   "start it again in 20 minutes",
+		},
+		{
+			name:     "cooled down",
+			limits:   StartLimits{CooldownMinutes: 30},
+			shutdown: time.Minute * 40,
+			player:   "alice",
+		},
+		{
+			name:   "server starts used up",
+			limits: StartLimits{ServerStartsPerDay: 2},
+			starts: []startRecord{
+				{Server: "test", Player: "bob", Started: ago(time.Hour * 20),
+					Stopped: ago(time.Hour * 19)},
+				{Server: "test", Player: "carol", Started: ago(time.Hour)},
+			},
+			player: "alice",
+			reason: "already been started twice today.\n" +
+				"It can be started again in 4 hours",
+		},
+		{
+			name:   "server start outside the window",
+			limits: StartLimits{ServerStartsPerDay: 2},
+			starts: []startRecord{
+				{Server: "test", Player: "bob", Started: ago(time.Hour * 25),
+					Stopped: ago(time.Hour * 23)},
+				{Server: "test", Player: "carol", Started: ago(time.Hour)},
+			},
+			player: "alice",
+		},
+		{
+			name:   "other servers' starts",
+			limits: StartLimits{ServerStartsPerDay: 1},
+			starts: []startRecord{
+				{Server: "other", Player: "alice", Started: ago(time.Hour)},
+			},
+			player: "alice",
+		},
+		{
+			name:   "player starts used up",
+			limits: StartLimits{PlayerStartsPerDay: 1},
+			starts: []startRecord{
+				{Server: "test", Player: "Alice", Started: ago(time.Hour * 2),
+					Stopped: ago(time.Hour)},
+			},
+			player: "alice",
+			reason: "you have already started the server once today.\n" +
+				"You can start it again in 22 hours",
+		},
+		{
+			name:   "other players' starts",
+			limits: StartLimits{PlayerStartsPerDay: 1},
+			starts: []startRecord{
+				{Server: "test", Player: "bob", Started: ago(time.Hour * 2),
+					Stopped: ago(time.Hour)},
+				{Server: "test", Player: "", Started: ago(time.Hour)},
+			},
+			player: "alice",
+		},
+		{
+			name:   "droplet hours used up",
+			limits: StartLimits{PlayerDropletHoursPerDay: 2},
+			starts: []startRecord{
+				{Server: "test", Player: "alice", Started: ago(time.Hour * 3),
+					Stopped: ago(time.Hour)},
+			},
+			player: "alice",
+			reason: "used up your 2 hours of server time for today.\n" +
+				"You can start the server again in 21 hours",
+		},
+		{
+			name:   "droplet hours left",
+			limits: StartLimits{PlayerDropletHoursPerDay: 2},
+			starts: []startRecord{
+				{Server: "test", Player: "alice", Started: ago(time.Hour)},
+			},
+			player: "alice",
+		},
+		{
+			name:   "droplet hours outside the window",
+			limits: StartLimits{PlayerDropletHoursPerDay: 2},
+			starts: []startRecord{
+				{Server: "test", Player: "alice", Started: ago(time.Hour * 26),
+					Stopped: ago(time.Hour * 23)},
+			},
+			player: "alice",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetStartUsage()
+			usage.Starts = append([]startRecord{}, test.starts...)
+			if test.shutdown > 0 {
+				usage.Shutdowns["test"] = ago(test.shutdown)
+			}
+
+			server := &Server{}
+			server.Name = "test"
+			server.StartLimits = test.limits
+
+			reason := server.checkAndRecordStart(test.player)
+			if test.reason == "" && reason != "" {
+				t.Fatalf("start was refused: %q", reason)
+			} else if !strings.Contains(reason, test.reason) {
+				t.Fatalf("got reason %q, want %q", reason, test.reason)
+			}
+
+			recorded := len(usage.Starts) > len(test.starts)
+			if recorded != (reason == "") {
+				t.Errorf("start recorded is %v with reason %q", recorded,
+					reason)
+			}
+
+			if recorded && usage.Starts[len(usage.Starts)-1].Player !=
+				test.player {
+				t.Errorf("got start recorded for %q, want %q",
+					usage.Starts[len(usage.Starts)-1].Player, test.player)
+			}
+		})
+	}
+}
+
+func TestCheckAndRecordStartConcurrently(t *testing.T) {
+	resetStartUsage()
+
+	server := &Server{}
+	server.Name = "test"
+	server.StartLimits = StartLimits{ServerStartsPerDay: 1}
+
+	wg := &sync.WaitGroup{}
+	allowed := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if server.checkAndRecordStart("alice") == "" {
+				allowed <- "alice"
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(allowed)
+
+	if len(allowed) != 1 || len(usage.Starts) != 1 {
+		t.Errorf("got %d starts allowed and %d recorded, want 1",
+			len(allowed), len(usage.Starts))
+	}
+}
+
+func TestStartUsageHook(t *testing.T) {
+	tests := []struct {
+		from state
+		to   state
+		// cooldown is whether the transition starts the cooldown.
+		cooldown bool
+		// stopped is whether the open start record is closed.
+		stopped bool
+	}{
+		{stateDestroy, stateOff, true, true},
+		{stateStarted, stateOff, true, true},
+		{stateStarting, stateOff, false, true},
+		{stateInitializing, stateOff, false, true},
+		{stateOff, stateStarting, false, false},
+		{stateStarted, stateShutdown, false, false},
+	}
+
+	for _, test := range tests {
+		resetStartUsage()
+		usage.Starts = []startRecord{
+			{Server: "test", Player: "alice", Started: ago(time.Hour)},
+			{Server: "other", Player: "alice", Started: ago(time.Hour)},
+		}
+
+		server := &Server{}
+		server.Name = "test"
+		startUsageHook(server, test.from, test.to)
+
+		_, cooldown := usage.Shutdowns["test"]
+		if cooldown != test.cooldown {
+			t.Errorf("%v to %v: got cooldown %v, want %v", test.from,
+				test.to, cooldown, test.cooldown)
+		}
+
+		stopped := !usage.Starts[0].Stopped.IsZero()
+		if stopped != test.stopped {
+			t.Errorf("%v to %v: got start stopped %v, want %v", test.from,
+				test.to, stopped, test.stopped)
+		}
+
+		if !usage.Starts[1].Stopped.IsZero() {
+			t.Errorf("%v to %v: stopped another server's start", test.from,
+				test.to)
+		}
+	}
+}
+
+func TestDropletTime(t *testing.T) {
+	now := time.Now()
+	at := func(hours float64) time.Time {
+		return now.Add(time.Duration(hours * float64(time.Hour)))
+	}
+
+	tests := []struct {
+		name    string
+		records []startRecord
+		want    time.Duration
+	}{
+		{"none", nil, 0},
+		{
+			"stopped",
+			[]startRecord{{Started: at(-3), Stopped: at(-1)}},
+			time.Hour * 2,
+		},
+		{
+			"running",
+			[]startRecord{{Started: at(-1.5)}},
+			time.Hour + time.Minute*30,
+		},
+		{
+			"partly outside the window",
+			[]startRecord{{Started: at(-26), Stopped: at(-23)}},
+			time.Hour,
+		},
+		{
+			"outside the window",
+			[]startRecord{{Started: at(-30), Stopped: at(-25)}},
+			0,
+		},
+		{
+			"several",
+			[]startRecord{
+				{Started: at(-10), Stopped: at(-9)},
+				{Started: at(-2), Stopped: at(-1)},
+				{Started: at(-0.5)},
+			},
+			time.Hour*2 + time.Minute*30,
+		},
+	}
+
+	for _, test := range tests {
+		if got := dropletTime(test.records, now); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFormatWait(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{time.Second * 3, "10 seconds"},
+		{time.Minute * 20, "20 minutes"},
+		{time.Minute * 59, "59 minutes"},
+		{time.Minute*59 + time.Second*45, "1 hour"},
+		{time.Minute * 89, "1 hour"},
+		{time.Minute * 90, "2 hours"},
+		{time.Hour * 21, "21 hours"},
+	}
+
+	for _, test := range tests {
+		if got := formatWait(test.wait); got != test.want {
+			t.Errorf("formatWait(%v) got %q, want %q", test.wait, got,
+				test.want)
+		}
+	}
+}
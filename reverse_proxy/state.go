@@ -1,15 +1,17 @@
 package main
 
 import (
+	"errors"
 	"github.com/1lann/beacon/chat"
 	"github.com/1lann/beacon/handler"
+	"net"
 	"time"
 )
 
 type state int
 
 const (
-	stateInitializing = iota
+	stateInitializing state = iota
 	stateOff
 	stateShutdown
 	stateSnapshot
@@ -17,12 +19,13 @@ const (
 	stateStarted
 	stateStarting
 	stateUnavailable
+	stateCrashed
 )
 
 func (s state) String() string {
 	switch s {
 	case stateInitializing:
-		return "Intializing"
+		return "Initializing"
 	case stateOff:
 		return "Off"
 	case stateSnapshot:
@@ -35,17 +38,160 @@ func (s state) String() string {
 		return "Started"
 	case stateStarting:
 		return "Starting"
+	case stateUnavailable:
+		return "Unavailable"
+	case stateCrashed:
+		return "Crashed"
 	}
 
 	return "Unknown"
 }
 
-func (s *Server) SetState(st state) {
+func (s state) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *state) UnmarshalText(text []byte) error {
+	for st := stateInitializing; st <= stateCrashed; st++ {
+		if st.String() == string(text) {
+			*s = st
+			return nil
+		}
+	}
+
+	return errors.New("state: unknown state " + string(text))
+}
+
+// stateTransitions lists the states each state may move to. Moving to the
+// same state is always allowed and does nothing. States observed from the
+// provider aren't checked against it, see observeState.
+var stateTransitions = map[state][]state{
+	stateInitializing: {stateOff, stateShutdown, stateSnapshot, stateDestroy,
+		stateStarted, stateStarting, stateUnavailable, stateCrashed},
+	stateOff: {stateStarting, stateStarted, stateUnavailable},
+	stateStarting: {stateStarted, stateShutdown, stateOff, stateUnavailable,
+		stateCrashed},
+	stateStarted: {stateStarting, stateShutdown, stateOff, stateUnavailable,
+		stateCrashed},
+	stateShutdown: {stateSnapshot, stateDestroy, stateOff, stateUnavailable},
+	stateSnapshot: {stateDestroy, stateOff, stateUnavailable},
+	stateDestroy:  {stateOff, stateUnavailable},
+	stateUnavailable: {stateOff, stateShutdown, stateSnapshot, stateDestroy,
+		stateStarted, stateStarting, stateCrashed},
+	stateCrashed: {stateOff, stateShutdown, stateStarted, stateStarting,
+		stateUnavailable},
+}
+
+const maxTransitionHistory = 50
+
+type stateTransition struct {
+	From state     `json:"from"`
+	To   state     `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+// stateHook is called after every accepted state transition.
+type stateHook func(s *Server, from state, to state)
+
+var stateHooks []stateHook
+
+// onStateTransition registers a hook to be called after every accepted state
+// transition of any server. Hooks are called synchronously from the goroutine
+// changing the state, and must not call SetState.
+func onStateTransition(hook stateHook) {
+	stateHooks = append(stateHooks, hook)
+}
+
+func logStateTransition(s *Server, from state, to state) {
+	s.Log("state", "Changed state from", from, "to", to)
+}
+
+// CanTransition returns whether the server is allowed to move to the given
+// state from its current state.
+func (s *Server) CanTransition(st state) bool {
+	s.transitionLock.Lock()
+	defer s.transitionLock.Unlock()
+	return s.canTransition(st)
+}
+
+func (s *Server) canTransition(st state) bool {
+	if st == s.State {
+		return true
+	}
+
+	for _, allowed := range stateTransitions[s.State] {
+		if allowed == st {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CurrentState returns the server's state, for goroutines which don't hold
+// the state lock.
+func (s *Server) CurrentState() state {
+	s.transitionLock.Lock()
+	defer s.transitionLock.Unlock()
+	return s.State
+}
+
+// TransitionHistory returns the most recent accepted state transitions,
+// oldest first.
+func (s *Server) TransitionHistory() []stateTransition {
+	s.transitionLock.Lock()
+	defer s.transitionLock.Unlock()
+	return append([]stateTransition{}, s.transitions...)
+}
+
+// SetState moves the server to the given state if the transition table
+// allows it, and returns whether the server is now in that state.
+func (s *Server) SetState(st state) bool {
+	return s.changeState(st, false)
+}
+
+// observeState moves the server to a state observed from the provider, such
+// as the droplet being snapshot. The provider is the authority on what the
+// droplet is doing, so observed states bypass the transition table.
+func (s *Server) observeState(st state) {
+	s.changeState(st, true)
+}
+
+func (s *Server) changeState(st state, observed bool) bool {
+	s.transitionLock.Lock()
+
 	if st == s.State && s.State != stateInitializing {
-		return
+		s.transitionLock.Unlock()
+		return true
+	}
+
+	if !observed && !s.canTransition(st) {
+		from := s.State
+		s.transitionLock.Unlock()
+		s.Warn("state", "Rejected transition from", from, "to", st)
+		return false
 	}
 
+	from := s.State
 	s.setStateRaw(st)
+
+	s.transitions = append(s.transitions, stateTransition{
+		From: from,
+		To:   st,
+		Time: time.Now(),
+	})
+	if len(s.transitions) > maxTransitionHistory {
+		s.transitions = s.transitions[len(s.transitions)-
+			maxTransitionHistory:]
+	}
+
+	s.transitionLock.Unlock()
+
+	for _, hook := range stateHooks {
+		hook(s, from, st)
+	}
+
+	return true
 }
 
 func (s *Server) setStateRaw(st state) {
@@ -72,10 +218,6 @@ func (s *Server) setStateRaw(st state) {
 			chat.Gold + "Powered off. Connect to start."
 		s.PingStatus.ShowConnection = true
 	case stateStarting:
-		s.ConnectMessage = "Sorry, the server is still starting up.\n" +
-			"Try connecting again in a few minutes."
-		s.PingStatus.Message = chat.Format(s.Messages.ServerInfoPrefix) +
-			chat.LightGreen + "Starting up..."
 		s.PingStatus.ShowConnection = false
 	case stateUnavailable:
 		s.ConnectMessage = "The server isn't available right now.\n" +
@@ -83,10 +225,21 @@ func (s *Server) setStateRaw(st state) {
 		s.PingStatus.Message = chat.Format(s.Messages.ServerInfoPrefix) +
 			chat.Red + "Unavailable."
 		s.PingStatus.ShowConnection = false
+	case stateCrashed:
+		s.ConnectMessage = "The server has crashed and could not be " +
+			"restarted.\nContact " + s.Messages.Owner + " for help."
+		s.PingStatus.Message = chat.Format(s.Messages.ServerInfoPrefix) +
+			chat.Red + "Crashed."
+		s.PingStatus.ShowConnection = false
 	case stateStarted:
 		s.LastConnectionTime = time.Now()
-		handler.Forward(s.Hostnames, s.IPAddress+":25565")
+		handler.Forward(s.Hostnames, net.JoinHostPort(s.IPAddress,
+			minecraftPort))
 	}
 
 	s.State = st
+
+	if st == stateStarting {
+		s.updateStartingMessage()
+	}
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// countTransitions replaces the state hooks with one counting transitions
+// until the end of the test.
+func countTransitions(t *testing.T) *int {
+	hooks := stateHooks
+	t.Cleanup(func() { stateHooks = hooks })
+
+	count := new(int)
+	stateHooks = []stateHook{func(s *Server, from state, to state) {
+		*count++
+	}}
+
+	return count
+}
+
+func newStateTestServer(st state) *Server {
+	server := &Server{StateLock: &sync.Mutex{}}
+	server.Name = testServerName
+	server.observeState(st)
+	return server
+}
+
+func TestSetState(t *testing.T) {
+	tests := []struct {
+		from    state
+		to      state
+		allowed bool
+	}{
+		{stateInitializing, stateSnapshot, true},
+		{stateOff, stateStarting, true},
+		{stateOff, stateSnapshot, false},
+		{stateOff, stateShutdown, false},
+		{stateOff, stateDestroy, false},
+		{stateOff, stateCrashed, false},
+		{stateStarting, stateStarted, true},
+		{stateStarting, stateSnapshot, false},
+		{stateStarted, stateShutdown, true},
+		{stateStarted, stateSnapshot, false},
+		{stateStarted, stateDestroy, false},
+		{stateShutdown, stateSnapshot, true},
+		{stateShutdown, stateStarting, false},
+		{stateShutdown, stateStarted, false},
+		{stateSnapshot, stateDestroy, true},
+		{stateSnapshot, stateShutdown, false},
+		{stateDestroy, stateOff, true},
+		{stateDestroy, stateStarting, false},
+		{stateUnavailable, stateSnapshot, true},
+		{stateCrashed, stateStarting, true},
+		{stateCrashed, stateSnapshot, false},
+	}
+
+	for _, test := range tests {
+		server := newStateTestServer(test.from)
+		transitions := countTransitions(t)
+
+		if server.CanTransition(test.to) != test.allowed {
+			t.Errorf("%v to %v: CanTransition returned %v", test.from,
+				test.to, !test.allowed)
+		}
+
+		if server.SetState(test.to) != test.allowed {
+			t.Errorf("%v to %v: SetState returned %v", test.from, test.to,
+				!test.allowed)
+		}
+
+		want, wantTransitions := test.to, 1
+		if !test.allowed {
+			want, wantTransitions = test.from, 0
+		}
+
+		if server.State != want {
+			t.Errorf("%v to %v: state is %v, want %v", test.from, test.to,
+				server.State, want)
+		}
+
+		if *transitions != wantTransitions {
+			t.Errorf("%v to %v: ran hooks for %d transitions, want %d",
+				test.from, test.to, *transitions, wantTransitions)
+		}
+
+		history := server.TransitionHistory()
+		if last := history[len(history)-1]; test.allowed &&
+			(last.From != test.from || last.To != test.to) {
+			t.Errorf("%v to %v: last transition in history is %v to %v",
+				test.from, test.to, last.From, last.To)
+		} else if !test.allowed && last.To != test.from {
+			t.Errorf("%v to %v: rejected transition is in history",
+				test.from, test.to)
+		}
+	}
+}
+
+func TestSetSameState(t *testing.T) {
+	server := newStateTestServer(stateStarted)
+	transitions := countTransitions(t)
+
+	if !server.SetState(stateStarted) {
+		t.Error("SetState to the same state returned false")
+	}
+
+	if *transitions != 0 {
+		t.Error("ran hooks for a transition to the same state")
+	}
+}
+
+func TestObserveState(t *testing.T) {
+	// Droplets can be seen doing anything, whatever the table says.
+	tests := []struct {
+		from state
+		to   state
+	}{
+		{stateOff, stateSnapshot},
+		{stateOff, stateShutdown},
+		{stateOff, stateDestroy},
+		{stateStarted, stateSnapshot},
+		{stateStarted, stateDestroy},
+		{stateStarting, stateSnapshot},
+		{stateCrashed, stateDestroy},
+		{stateShutdown, stateStarting},
+		{stateSnapshot, stateStarting},
+	}
+
+	for _, test := range tests {
+		server := newStateTestServer(test.from)
+		transitions := countTransitions(t)
+
+		if server.CanTransition(test.to) {
+			t.Errorf("%v to %v is in the transition table", test.from,
+				test.to)
+		}
+
+		server.observeState(test.to)
+		if server.State != test.to {
+			t.Errorf("%v to %v: observed state is %v", test.from, test.to,
+				server.State)
+		}
+
+		if *transitions != 1 {
+			t.Errorf("%v to %v: ran hooks for %d transitions, want 1",
+				test.from, test.to, *transitions)
+		}
+	}
+}
+
+func TestShutdownRejected(t *testing.T) {
+	actionCooldown = 0
+
+	for _, shutdown := range []func(s *Server){
+		(*Server).Shutdown,
+		(*Server).ForceShutdownNow,
+	} {
+		server := newStateTestServer(stateOff)
+		transitions := countTransitions(t)
+
+		// Shutting down from off is rejected before the backend or the
+		// provider are contacted, and the test has neither.
+		shutdown(server)
+
+		if server.State != stateOff || server.Operation != operationNone ||
+			*transitions != 0 {
+			t.Errorf("got state %v and operation %q after %d transitions, "+
+				"want to stay off", server.State, server.Operation,
+				*transitions)
+		}
+	}
+}
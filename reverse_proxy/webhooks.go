@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhooks are HTTP endpoints which are sent a POST request when something
+// happens to a server, such as a state transition or a player starting it.
+// They are configured globally and per server, and can be limited to some
+// events. Payloads are JSON, or formatted for Discord or Slack with a preset,
+// and are signed with HMAC-SHA256 when a secret is set. Failed deliveries are
+// retried, and the most recent deliveries are kept for the admin API.
+
+// Webhook events.
+const (
+	webhookStateChanged      = "state_changed"
+	webhookStartRequested    = "start_requested"
+	webhookAutoShutdown      = "auto_shutdown"
+	webhookSnapshotCompleted = "snapshot_completed"
+	webhookActionFailed      = "action_failed"
+	webhookSafetyCheck       = "safety_check"
+)
+
+// Webhook presets.
+const (
+	webhookPresetDiscord = "discord"
+	webhookPresetSlack   = "slack"
+)
+
+const webhookAttempts = 4
+
+// webhookRetryWait is how long to wait before retrying a delivery for the
+// first time. It doubles after every attempt.
+var webhookRetryWait = time.Second * 5
+
+const maxWebhookDeliveries = 100
+
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Preset is "discord" or "slack" to format payloads as chat messages.
+	Preset string `json:"preset"`
+	// Secret signs payloads in the X-Dynamicserver-Signature header.
+	Secret string `json:"secret"`
+	// Events lists the events sent to the webhook, or every event if empty.
+	Events []string `json:"events"`
+}
+
+type webhookPayload struct {
+	Event   string                 `json:"event"`
+	Server  string                 `json:"server"`
+	State   state                  `json:"state"`
+	Time    time.Time              `json:"time"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+type webhookDelivery struct {
+	ID        int       `json:"id"`
+	Time      time.Time `json:"time"`
+	URL       string    `json:"url"`
+	Event     string    `json:"event"`
+	Server    string    `json:"server"`
+	Attempts  int       `json:"attempts"`
+	Delivered bool      `json:"delivered"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var webhookClient = &http.Client{Timeout: time.Second * 10}
+
+var webhooksLock = &sync.Mutex{}
+var globalWebhooks []WebhookConfig
+var webhookDeliveries []webhookDelivery
+var lastDeliveryID int
+
+// setGlobalWebhooks replaces the webhooks which are sent every server's
+// events.
+func setGlobalWebhooks(webhooks []WebhookConfig) {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	globalWebhooks = webhooks
+}
+
+func (w WebhookConfig) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, wanted := range w.Events {
+		if wanted == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notifyWebhooks sends an event to the global webhooks and the server's
+// webhooks which want it. Deliveries happen in the background. Only the
+// leader sends webhooks, so that standby reverse proxies don't send every
+// event again.
+func (s *Server) notifyWebhooks(event string, message string,
+	data map[string]interface{}) {
+	if !isLeader() {
+		return
+	}
+
+	payload := webhookPayload{
+		Event:   event,
+		Server:  s.Name,
+		State:   s.State,
+		Time:    time.Now(),
+		Message: message,
+		Data:    data,
+	}
+
+	webhooksLock.Lock()
+	webhooks := append(append([]WebhookConfig{}, globalWebhooks...),
+		s.Webhooks...)
+	webhooksLock.Unlock()
+
+	for _, webhook := range webhooks {
+		if webhook.wants(event) {
+			go s.deliverWebhook(webhook, payload)
+		}
+	}
+}
+
+func webhookStateHook(s *Server, from state, to state) {
+	// Servers become Initializing and then settle every time we start, which
+	// isn't news to anyone.
+	if from == stateInitializing || to == stateInitializing {
+		return
+	}
+
+	s.notifyWebhooks(webhookStateChanged, "Changed state from "+
+		from.String()+" to "+to.String()+".", map[string]interface{}{
+		"from": from,
+		"to":   to,
+	})
+}
+
+// webhookBody returns the body sent to the webhook for the payload.
+func webhookBody(webhook WebhookConfig, payload webhookPayload) ([]byte,
+	error) {
+	switch webhook.Preset {
+	case "":
+		return json.Marshal(payload)
+	case webhookPresetDiscord:
+		return json.Marshal(map[string]string{
+			"content": "**" + payload.Server + "**: " + payload.Message,
+		})
+	case webhookPresetSlack:
+		return json.Marshal(map[string]string{
+			"text": "*" + payload.Server + "*: " + payload.Message,
+		})
+	}
+
+	return nil, errors.New("unknown preset \"" + webhook.Preset + "\"")
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// redactURL removes the path and query from a URL, which often contain the
+// webhook's credentials.
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return "(invalid URL)"
+	}
+
+	return parsed.Scheme + "://" + parsed.Host + "/..."
+}
+
+func (s *Server) deliverWebhook(webhook WebhookConfig,
+	payload webhookPayload) {
+	delivery := webhookDelivery{
+		Time:   payload.Time,
+		URL:    redactURL(webhook.URL),
+		Event:  payload.Event,
+		Server: payload.Server,
+	}
+
+	body, err := webhookBody(webhook, payload)
+	if err != nil {
+		delivery.Error = err.Error()
+		s.Warn("webhooks", "Failed to encode webhook:", err)
+		recordWebhookDelivery(delivery)
+		return
+	}
+
+	wait := webhookRetryWait
+	for delivery.Attempts < webhookAttempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+
+		delivery.Attempts++
+		delivery.Status, err = postWebhook(webhook, payload.Event, body)
+		if err == nil {
+			delivery.Delivered = true
+			delivery.Error = ""
+			s.Debug("webhooks", "Delivered", payload.Event, "to",
+				delivery.URL)
+			break
+		}
+
+		delivery.Error = err.Error()
+		s.Warn("webhooks", "Failed to deliver", payload.Event, "to",
+			delivery.URL+":", err)
+
+		// The webhook won't accept the request no matter how often it's
+		// retried.
+		if delivery.Status >= 400 && delivery.Status < 500 &&
+			delivery.Status != http.StatusTooManyRequests {
+			break
+		}
+	}
+
+	if !delivery.Delivered {
+		s.Error("webhooks", "Giving up delivering", payload.Event, "to",
+			delivery.URL+".")
+	}
+
+	recordWebhookDelivery(delivery)
+}
+
+// postWebhook makes a single delivery attempt, and returns the response's
+// status code.
+func postWebhook(webhook WebhookConfig, event string, body []byte) (int,
+	error) {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dynamicserver/"+version)
+	req.Header.Set("X-Dynamicserver-Event", event)
+	if webhook.Secret != "" {
+		req.Header.Set("X-Dynamicserver-Signature",
+			signWebhook(webhook.Secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.New("unexpected status " +
+			strconv.Itoa(resp.StatusCode))
+	}
+
+	return resp.StatusCode, nil
+}
+
+func recordWebhookDelivery(delivery webhookDelivery) {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+
+	lastDeliveryID++
+	delivery.ID = lastDeliveryID
+
+	webhookDeliveries = append(webhookDeliveries, delivery)
+	if len(webhookDeliveries) > maxWebhookDeliveries {
+		webhookDeliveries = webhookDeliveries[len(webhookDeliveries)-
+			maxWebhookDeliveries:]
+	}
+}
+
+// handleWebhookDeliveries lists the most recent webhook deliveries, newest
+// first.
+func handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	webhooksLock.Lock()
+	deliveries := []webhookDelivery{}
+	for i := len(webhookDeliveries) - 1; i >= 0; i-- {
+		deliveries = append(deliveries, webhookDeliveries[i])
+	}
+	webhooksLock.Unlock()
+
+	writeJSON(w, http.StatusOK, deliveries)
+}